@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nlowe/grafana-agent-operator/config"
+	"github.com/nlowe/grafana-agent-operator/httputil"
+	"github.com/nlowe/grafana-agent-operator/operator"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// agentConfigManager creates a ConfigManager for commands that cannot do anything useful without an agent
+func agentConfigManager() (operator.ConfigManager, error) {
+	manager, err := newConfigManager()
+	if err != nil {
+		return nil, err
+	} else if manager == nil {
+		return nil, fmt.Errorf("one of --agent-url, --agent-config-file or --agent-config-map is required")
+	}
+
+	return dryRunConfigManager(manager)
+}
+
+// newConfigManager creates a ConfigManager for the scraping service API at --agent-url, or for the agent config
+// file shared by agents running as a DaemonSet. It returns nil if none of them are configured.
+func newConfigManager() (operator.ConfigManager, error) {
+	if agentUrl := viper.GetString("agent-url"); agentUrl != "" {
+		return newGrafanaAgentConfigManager(agentUrl), nil
+	}
+
+	if path := viper.GetString("agent-config-file"); path != "" {
+		return operator.NewConfigFileManager(operator.NewFileConfigStore(path)), nil
+	}
+
+	if cm := viper.GetString("agent-config-map"); cm != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(cm)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --agent-config-map: %w", err)
+		}
+
+		cfg, err := restConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return operator.NewConfigFileManager(operator.NewConfigMapConfigStore(
+			client, namespace, name, viper.GetString("agent-config-map-key"),
+		)), nil
+	}
+
+	return nil, nil
+}
+
+// newGrafanaAgentConfigManager creates a ConfigManager for the agent at agentUrl using the retry and circuit
+// breaker settings
+func newGrafanaAgentConfigManager(agentUrl string) operator.ConfigManager {
+	opts := []operator.ConfigManagerOption{
+		operator.WithRetryPolicy(httputil.RetryPolicy{
+			MaxRetries: viper.GetInt("agent-retries"),
+			MinBackoff: viper.GetDuration("agent-retry-min-backoff"),
+			MaxBackoff: viper.GetDuration("agent-retry-max-backoff"),
+		}),
+	}
+
+	if threshold := viper.GetInt("agent-breaker-threshold"); threshold > 0 {
+		opts = append(opts, operator.WithCircuitBreaker(
+			httputil.NewCircuitBreaker(threshold, viper.GetDuration("agent-breaker-cooldown")),
+		))
+	}
+
+	return operator.NewGrafanaAgentConfigManager(agentUrl, opts...)
+}
+
+// dryRunConfigManager wraps manager so it only logs changes when running with --dry-run
+func dryRunConfigManager(manager operator.ConfigManager) (operator.ConfigManager, error) {
+	if !viper.GetBool("dry-run") {
+		return manager, nil
+	}
+
+	var out io.Writer
+	if path := viper.GetString("dry-run-output"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open --dry-run-output: %w", err)
+		}
+
+		out = f
+	}
+
+	logrus.Warn("Running in dry run mode, changes will not be applied")
+	return operator.NewDryRunConfigManager(manager, out), nil
+}
+
+// ownedConfigNames returns the names of all configs generated for the ServiceMonitors in the cluster
+func ownedConfigNames(ctx context.Context) (map[string]struct{}, error) {
+	sms, err := listServiceMonitors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]struct{}{}
+	for _, sm := range sms {
+		for _, name := range config.InstanceNames(sm) {
+			result[name] = struct{}{}
+		}
+	}
+
+	return result, nil
+}
+
+// offlineConfigWriter creates a config.Writer for commands that generate configs outside the controller. Only
+// the controller mints API server tokens, so a placeholder stands in for the token, which is scrubbed when
+// configs are compared with the agent. namespaces must be set if labels are copied from namespaces, since the
+// configs would differ from the ones the controller generates without them.
+func offlineConfigWriter(namespaces corelisters.NamespaceLister) (config.Writer, error) {
+	var opts []config.Option
+	if viper.GetString("sd-token-service-account") != "" {
+		opts = append(opts, config.WithAPIServerBearerToken("minted-by-operator"))
+	}
+
+	if namespaces != nil {
+		opts = append(opts, config.WithNamespaceLister(namespaces))
+	} else if len(viper.GetStringSlice("namespace-labels")) > 0 {
+		return nil, fmt.Errorf("namespace-labels requires access to the Namespaces in the cluster")
+	}
+
+	return operator.NewConfigWriter(opts...)
+}
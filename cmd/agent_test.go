@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned"
+	monitoringfake "github.com/prometheus-operator/prometheus-operator/pkg/client/versioned/fake"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeAgent serves the parts of the scraping service API the commands use from an in-memory config store
+type fakeAgent struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	configs map[string]string
+	deleted []string
+}
+
+func newFakeAgent(t *testing.T, configs ...*instance.Config) *fakeAgent {
+	agent := &fakeAgent{configs: map[string]string{}}
+	for _, cfg := range configs {
+		raw, err := instance.MarshalConfig(cfg, false)
+		require.NoError(t, err)
+
+		agent.configs[cfg.Name] = string(raw)
+	}
+
+	agent.Server = httptest.NewServer(http.HandlerFunc(agent.serve))
+	t.Cleanup(agent.Close)
+
+	return agent
+}
+
+func (a *fakeAgent) serve(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	respond := func(code int, data interface{}) {
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+	}
+
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodGet && path == "/agent/api/v1/configs":
+		names := []string{}
+		for name := range a.configs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		respond(http.StatusOK, map[string]interface{}{"configs": names})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/agent/api/v1/configs/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/agent/api/v1/configs/"))
+		if raw, ok := a.configs[name]; ok {
+			respond(http.StatusOK, map[string]interface{}{"value": raw})
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/agent/api/v1/config/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/agent/api/v1/config/"))
+		if _, ok := a.configs[name]; ok {
+			delete(a.configs, name)
+			a.deleted = append(a.deleted, name)
+			respond(http.StatusOK, nil)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Deleted returns the names of the configs that were deleted, in order
+func (a *fakeAgent) Deleted() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return append([]string(nil), a.deleted...)
+}
+
+// fakeCluster replaces the clients the commands use with fake clientsets serving objects until the test ends
+func fakeCluster(t *testing.T, sms []*monitoringv1.ServiceMonitor, objects ...runtime.Object) {
+	monitoringObjects := make([]runtime.Object, len(sms))
+	for i, sm := range sms {
+		monitoringObjects[i] = sm
+	}
+
+	prevKube, prevMonitoring := newKubeClient, newMonitoringClient
+	t.Cleanup(func() {
+		newKubeClient, newMonitoringClient = prevKube, prevMonitoring
+	})
+
+	newKubeClient = func() (kubernetes.Interface, error) {
+		return kubefake.NewSimpleClientset(objects...), nil
+	}
+	newMonitoringClient = func() (versioned.Interface, error) {
+		return monitoringfake.NewSimpleClientset(monitoringObjects...), nil
+	}
+}
+
+// runCommand runs the operator with args and stdin, returning what it printed to stdout
+func runCommand(t *testing.T, stdin string, args ...string) (string, error) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	var out bytes.Buffer
+	cmd := NewRootCmd()
+	cmd.SetArgs(append(args, "--remote-write-url", "http://cortex.monitoring.svc.cluster.local/api/prom/push"))
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetOut(&out)
+	cmd.SetErr(ioutil.Discard)
+
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestOfflineConfigWriter(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("remote-write-url", "http://cortex.monitoring.svc.cluster.local/api/prom/push")
+
+	_, err := offlineConfigWriter(nil)
+	require.NoError(t, err)
+
+	viper.Set("namespace-labels", []string{"team=example.com/team"})
+	_, err = offlineConfigWriter(nil)
+	require.Error(t, err, "configs without namespace labels must not be rendered or compared")
+	assert.Contains(t, err.Error(), "namespace-labels requires access to the Namespaces in the cluster")
+
+	_, err = offlineConfigWriter(corelisters.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})))
+	require.NoError(t, err)
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	"github.com/nlowe/grafana-agent-operator/k8sutil"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var errDrift = errors.New("the agent configs differ from the desired configs")
+
+func NewDiffCmd() *cobra.Command {
+	var files []string
+	var namespace string
+
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "compares the desired configs with the configs in the agent",
+		Long: "Renders the ServiceMonitors in the cluster, or in the manifests specified with --filename, and " +
+			"prints a unified diff against the configs stored in the agent, including configs that would be " +
+			"created or deleted. Invalid ServiceMonitors are reported and skipped along with their existing configs, " +
+			"since the operator leaves them alone. Exits with a non-zero exit code if any configs differ.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			logToStderr()
+			cmd.SilenceUsage = true
+
+			manager, err := agentConfigManager()
+			if err != nil {
+				return err
+			}
+
+			var sms []*monitoringv1.ServiceMonitor
+			var namespaces corelisters.NamespaceLister
+			if len(files) > 0 {
+				sms, err = k8sutil.ReadServiceMonitors(files...)
+			} else {
+				sms, err = listServiceMonitors(cmd.Context())
+			}
+			if err != nil {
+				return err
+			}
+
+			if namespaces, err = listNamespaces(cmd.Context()); err != nil {
+				return err
+			}
+
+			writer, err := offlineConfigWriter(namespaces)
+			if err != nil {
+				return err
+			}
+
+			desired := map[string]*instance.Config{}
+			skipped := map[string]struct{}{}
+			invalid := 0
+			for _, sm := range sms {
+				if sm.Namespace == "" {
+					sm.Namespace = namespace
+				}
+
+				// The operator does not sync invalid ServiceMonitors and leaves their existing configs alone
+				if err := writer.Validate(sm); err != nil {
+					logrus.WithField("serviceMonitor", sm.Namespace+"/"+sm.Name).WithError(err).Error("Skipping invalid ServiceMonitor")
+					for _, name := range config.InstanceNames(sm) {
+						skipped[name] = struct{}{}
+					}
+					invalid++
+					continue
+				}
+
+				cfgs, _, err := writer.ScrapeConfigsForServiceMonitor(sm)
+				if err != nil {
+					return fmt.Errorf("failed to generate configs for %s/%s: %w", sm.Namespace, sm.Name, err)
+				}
+
+				for _, cfg := range cfgs {
+					desired[cfg.Name] = cfg
+				}
+			}
+
+			live, err := manager.ListScrapeConfigs()
+			if err != nil {
+				return err
+			}
+
+			names := make([]string, 0, len(desired))
+			for name := range desired {
+				names = append(names, name)
+			}
+
+			existing := map[string]*instance.Config{}
+			for _, name := range live {
+				if _, skip := skipped[name]; skip {
+					continue
+				}
+
+				if existing[name], err = manager.GetScrapeConfig(name); err != nil {
+					return err
+				}
+
+				if _, ok := desired[name]; !ok {
+					names = append(names, name)
+				}
+			}
+
+			sort.Strings(names)
+
+			out := cmd.OutOrStdout()
+			changed := 0
+			for _, name := range names {
+				diff, err := config.Diff(name, existing[name], desired[name])
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+
+				if diff != "" {
+					changed++
+					_, _ = fmt.Fprint(out, diff)
+				}
+			}
+
+			logrus.Infof("%d of %d configs differ", changed, len(names))
+			if invalid > 0 {
+				logrus.Warnf("Skipped %d invalid ServiceMonitors", invalid)
+			}
+
+			if changed > 0 {
+				return errDrift
+			}
+
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&files, "filename", "f", nil, "Files or directories containing ServiceMonitors to compare instead of the ServiceMonitors in the cluster, - for stdin")
+	flags.StringVarP(&namespace, "namespace", "n", "default", "The namespace to use for ServiceMonitors from files that do not specify one")
+
+	return cmd
+}
+
+func listServiceMonitors(ctx context.Context) ([]*monitoringv1.ServiceMonitor, error) {
+	monitoring, err := newMonitoringClient()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := monitoring.MonitoringV1().ServiceMonitors(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ServiceMonitors: %w", err)
+	}
+
+	return list.Items, nil
+}
+
+// listNamespaces returns a lister for the Namespaces in the cluster if labels are copied from them, or nil
+func listNamespaces(ctx context.Context) (corelisters.NamespaceLister, error) {
+	if len(viper.GetStringSlice("namespace-labels")) == 0 {
+		return nil, nil
+	}
+
+	k8s, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := k8s.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Namespaces: %w", err)
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i := range list.Items {
+		if err := indexer.Add(&list.Items[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return corelisters.NewNamespaceLister(indexer), nil
+}
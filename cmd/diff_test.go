@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/operator"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	promcfg "github.com/prometheus/prometheus/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDiff(t *testing.T) {
+	sms := []*monitoringv1.ServiceMonitor{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "second", Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}}},
+		},
+	}
+
+	// The configs the operator would sync for sms
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("remote-write-url", "http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	writer, err := operator.NewConfigWriter()
+	require.NoError(t, err)
+
+	var desired []*instance.Config
+	for _, sm := range sms {
+		cfgs, _, err := writer.ScrapeConfigsForServiceMonitor(sm)
+		require.NoError(t, err)
+		desired = append(desired, cfgs...)
+	}
+
+	t.Run("In Sync", func(t *testing.T) {
+		fakeCluster(t, sms)
+		agent := newFakeAgent(t, desired...)
+
+		out, err := runCommand(t, "", "diff", "--agent-url", agent.URL)
+		require.NoError(t, err)
+		assert.Empty(t, out)
+	})
+
+	t.Run("Drift", func(t *testing.T) {
+		sc := *desired[1].ScrapeConfigs[0]
+		sc.MetricsPath = "/edited"
+		modified := *desired[1]
+		modified.ScrapeConfigs = []*promcfg.ScrapeConfig{&sc}
+
+		fakeCluster(t, sms)
+		agent := newFakeAgent(t, desired[0], &modified, &instance.Config{Name: "myapp/removed/0"})
+
+		out, err := runCommand(t, "", "diff", "--agent-url", agent.URL)
+		require.Equal(t, errDrift, err)
+		assert.Contains(t, out, "myapp/second/0")
+		assert.Contains(t, out, "/edited")
+		assert.Contains(t, out, "myapp/removed/0")
+		assert.NotContains(t, out, "myapp/first/0", "configs in sync were reported")
+		assert.Empty(t, agent.Deleted(), "diff changed the agent")
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		fakeCluster(t, sms)
+		agent := newFakeAgent(t, desired[0])
+
+		out, err := runCommand(t, "", "diff", "--agent-url", agent.URL)
+		require.Equal(t, errDrift, err)
+		assert.Contains(t, out, "myapp/second/0")
+	})
+
+	t.Run("Skips Invalid", func(t *testing.T) {
+		invalid := &monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: "invalid", Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "web("}}},
+		}
+
+		fakeCluster(t, append([]*monitoringv1.ServiceMonitor{invalid}, sms...))
+		agent := newFakeAgent(t, append([]*instance.Config{{Name: "myapp/invalid/0"}}, desired...)...)
+
+		out, err := runCommand(t, "", "diff", "--agent-url", agent.URL)
+		require.NoError(t, err, "the config of the invalid ServiceMonitor was reported as drift")
+		assert.Empty(t, out)
+	})
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newKubeClient and newMonitoringClient create the clients the commands other than the operator itself use to
+// talk to the cluster. Tests replace them with fake clientsets.
+var (
+	newKubeClient = func() (kubernetes.Interface, error) {
+		cfg, err := restConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return kubernetes.NewForConfig(cfg)
+	}
+
+	newMonitoringClient = func() (versioned.Interface, error) {
+		cfg, err := restConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return versioned.NewForConfig(cfg)
+	}
+)
+
+func restConfig() (*rest.Config, error) {
+	cfg, err := loadRestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.QPS = float32(viper.GetFloat64("kube-qps"))
+	cfg.Burst = viper.GetInt("kube-burst")
+
+	return cfg, nil
+}
+
+func loadRestConfig() (*rest.Config, error) {
+	if viper.GetBool("in-cluster") {
+		logrus.Info("Running in-cluster")
+		return rest.InClusterConfig()
+	}
+
+	// Follows kubectl: an explicit --kubeconfig wins, otherwise the paths in KUBECONFIG are merged, falling back to
+	// ~/.kube/config
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = viper.GetString("kubeconfig")
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: viper.GetString("context")}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	raw, err := clientConfig.RawConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	context := raw.CurrentContext
+	if overrides.CurrentContext != "" {
+		context = overrides.CurrentContext
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"kubeconfig": rules.GetLoadingPrecedence(),
+		"context":    context,
+	}).Info("Using kubeconfig")
+
+	return clientConfig.ClientConfig()
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: one
+clusters:
+- name: one
+  cluster:
+    server: https://one.example.com
+- name: two
+  cluster:
+    server: https://two.example.com
+contexts:
+- name: one
+  context:
+    cluster: one
+    user: user
+- name: two
+  context:
+    cluster: two
+    user: user
+users:
+- name: user
+  user:
+    token: hunter2
+`
+
+func TestRestConfig(t *testing.T) {
+	setup := func(t *testing.T, args ...string) {
+		viper.Reset()
+		cmd := NewRootCmd()
+		require.NoError(t, cmd.PersistentFlags().Parse(args))
+		require.NoError(t, loadSettings(cmd.PersistentFlags()))
+	}
+
+	path := writeConfigFile(t, testKubeconfig)
+
+	t.Run("Current Context", func(t *testing.T) {
+		setup(t, "--kubeconfig", path)
+
+		cfg, err := restConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "https://one.example.com", cfg.Host)
+		assert.Equal(t, float32(5), cfg.QPS)
+		assert.Equal(t, 10, cfg.Burst)
+	})
+
+	t.Run("Explicit Context", func(t *testing.T) {
+		setup(t, "--kubeconfig", path, "--context", "two", "--kube-qps", "50", "--kube-burst", "100")
+
+		cfg, err := restConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "https://two.example.com", cfg.Host)
+		assert.Equal(t, float32(50), cfg.QPS)
+		assert.Equal(t, 100, cfg.Burst)
+	})
+
+	t.Run("KUBECONFIG", func(t *testing.T) {
+		require.NoError(t, os.Setenv("KUBECONFIG", path))
+		defer func() {
+			_ = os.Unsetenv("KUBECONFIG")
+		}()
+
+		setup(t, "--context", "two")
+
+		cfg, err := restConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "https://two.example.com", cfg.Host)
+	})
+
+	t.Run("Unknown Context", func(t *testing.T) {
+		setup(t, "--kubeconfig", path, "--context", "three")
+
+		_, err := restConfig()
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/nlowe/grafana-agent-operator/config"
+	"github.com/spf13/cobra"
+)
+
+const (
+	ownerAny      = ""
+	ownerLive     = "live"
+	ownerOrphaned = "orphaned"
+)
+
+type listedConfig struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace,omitempty"`
+	ServiceMonitor string `json:"serviceMonitor,omitempty"`
+	Endpoint       *int   `json:"endpoint,omitempty"`
+	Owned          *bool  `json:"owned,omitempty"`
+}
+
+func NewListCmd() *cobra.Command {
+	var namespace, serviceMonitor, owner, output string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "lists the configs stored in the agent",
+		Long: "Lists the configs stored in the agent, optionally filtered by the namespace and name of the " +
+			"ServiceMonitor they were generated for. --owner=live or --owner=orphaned additionally lists the " +
+			"ServiceMonitors in the cluster to only show configs that do or do not belong to one.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			logToStderr()
+			cmd.SilenceUsage = true
+
+			if owner != ownerAny && owner != ownerLive && owner != ownerOrphaned {
+				return fmt.Errorf("invalid --owner '%s', expected one of [%s, %s]", owner, ownerLive, ownerOrphaned)
+			}
+
+			if output != "table" && output != "json" {
+				return fmt.Errorf("invalid --output '%s', expected one of [table, json]", output)
+			}
+
+			manager, err := agentConfigManager()
+			if err != nil {
+				return err
+			}
+
+			names, err := manager.ListScrapeConfigs()
+			if err != nil {
+				return err
+			}
+			sort.Strings(names)
+
+			var owned map[string]struct{}
+			if owner != ownerAny {
+				if owned, err = ownedConfigNames(cmd.Context()); err != nil {
+					return err
+				}
+			}
+
+			results := []listedConfig{}
+			for _, name := range names {
+				result := listedConfig{Name: name}
+
+				if ns, sm, ep, ok := config.ParseInstanceName(name); ok {
+					result.Namespace = ns
+					result.ServiceMonitor = sm
+					result.Endpoint = &ep
+				}
+
+				if (namespace != "" && result.Namespace != namespace) || (serviceMonitor != "" && result.ServiceMonitor != serviceMonitor) {
+					continue
+				}
+
+				if owned != nil {
+					_, isOwned := owned[name]
+					if (owner == ownerLive) != isOwned {
+						continue
+					}
+
+					result.Owned = &isOwned
+				}
+
+				results = append(results, result)
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(results)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 3, ' ', 0)
+			_, _ = fmt.Fprintln(w, "NAME\tNAMESPACE\tSERVICEMONITOR\tENDPOINT\tOWNED")
+			for _, result := range results {
+				endpoint, owned := "", ""
+				if result.Endpoint != nil {
+					endpoint = strconv.Itoa(*result.Endpoint)
+				}
+				if result.Owned != nil {
+					owned = strconv.FormatBool(*result.Owned)
+				}
+
+				_, _ = fmt.Fprintf(
+					w, "%s\t%s\t%s\t%s\t%s\n",
+					result.Name, orNone(result.Namespace), orNone(result.ServiceMonitor), orNone(endpoint), orNone(owned),
+				)
+			}
+
+			return w.Flush()
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&namespace, "namespace", "n", "", "Only list configs for ServiceMonitors in this namespace")
+	flags.StringVar(&serviceMonitor, "service-monitor", "", "Only list configs for ServiceMonitors with this name")
+	flags.StringVar(&owner, "owner", ownerAny, "Only list configs that belong to a ServiceMonitor in the cluster (live) or that do not (orphaned)")
+	flags.StringVarP(&output, "output", "o", "table", "The output format [table, json]")
+
+	return cmd
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+
+	return s
+}
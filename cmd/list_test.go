@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestList(t *testing.T) {
+	setup := func(t *testing.T) *fakeAgent {
+		fakeCluster(t, []*monitoringv1.ServiceMonitor{{
+			ObjectMeta: metav1.ObjectMeta{Name: "live", Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}}},
+		}})
+
+		return newFakeAgent(t,
+			&instance.Config{Name: "myapp/live/0"},
+			&instance.Config{Name: "myapp/live/1"},
+			&instance.Config{Name: "other/removed/0"},
+			&instance.Config{Name: "hand-made"},
+		)
+	}
+
+	list := func(t *testing.T, args ...string) []listedConfig {
+		agent := setup(t)
+
+		out, err := runCommand(t, "", append([]string{"list", "--agent-url", agent.URL, "-o", "json"}, args...)...)
+		require.NoError(t, err)
+
+		var result []listedConfig
+		require.NoError(t, json.Unmarshal([]byte(out), &result))
+
+		return result
+	}
+
+	names := func(configs []listedConfig) []string {
+		result := []string{}
+		for _, cfg := range configs {
+			result = append(result, cfg.Name)
+		}
+
+		return result
+	}
+
+	t.Run("All", func(t *testing.T) {
+		result := list(t)
+
+		assert.Equal(t, []string{"hand-made", "myapp/live/0", "myapp/live/1", "other/removed/0"}, names(result))
+		assert.Equal(t, "myapp", result[1].Namespace)
+		assert.Equal(t, "live", result[1].ServiceMonitor)
+		require.NotNil(t, result[1].Endpoint)
+		assert.Equal(t, 0, *result[1].Endpoint)
+		assert.Nil(t, result[1].Owned, "ownership is only looked up with --owner")
+	})
+
+	t.Run("Namespace", func(t *testing.T) {
+		assert.Equal(t, []string{"other/removed/0"}, names(list(t, "-n", "other")))
+	})
+
+	t.Run("Service Monitor", func(t *testing.T) {
+		assert.Equal(t, []string{"myapp/live/0", "myapp/live/1"}, names(list(t, "--service-monitor", "live")))
+	})
+
+	t.Run("Live", func(t *testing.T) {
+		result := list(t, "--owner", "live")
+
+		assert.Equal(t, []string{"myapp/live/0"}, names(result))
+		require.NotNil(t, result[0].Owned)
+		assert.True(t, *result[0].Owned)
+	})
+
+	t.Run("Orphaned", func(t *testing.T) {
+		result := list(t, "--owner", "orphaned")
+
+		assert.Equal(t, []string{"hand-made", "myapp/live/1", "other/removed/0"}, names(result))
+		for _, cfg := range result {
+			require.NotNil(t, cfg.Owned)
+			assert.False(t, *cfg.Owned)
+		}
+	})
+
+	t.Run("Table", func(t *testing.T) {
+		agent := setup(t)
+
+		out, err := runCommand(t, "", "list", "--agent-url", agent.URL, "--service-monitor", "live")
+		require.NoError(t, err)
+		assert.Equal(t, "NAME           NAMESPACE   SERVICEMONITOR   ENDPOINT   OWNED\n"+
+			"myapp/live/0   myapp       live             0          <none>\n"+
+			"myapp/live/1   myapp       live             1          <none>\n", out)
+	})
+
+	t.Run("Invalid Owner", func(t *testing.T) {
+		agent := setup(t)
+
+		_, err := runCommand(t, "", "list", "--agent-url", agent.URL, "--owner", "mine")
+		require.EqualError(t, err, "invalid --owner 'mine', expected one of [live, orphaned]")
+	})
+}
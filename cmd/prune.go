@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/operator"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewPruneCmd() *cobra.Command {
+	var match string
+	var orphaned, yes bool
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "deletes configs from the agent",
+		Long: "Deletes the configs stored in the agent whose name matches the --match regular expression and/or " +
+			"that do not belong to any ServiceMonitor in the cluster (--orphaned). When both are specified, only " +
+			"configs matching both are deleted.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			logToStderr()
+
+			if match == "" && !orphaned {
+				return fmt.Errorf("at least one of --match or --orphaned is required")
+			}
+
+			var re *regexp.Regexp
+			if match != "" {
+				var err error
+				if re, err = regexp.Compile(match); err != nil {
+					return fmt.Errorf("invalid --match: %w", err)
+				}
+			}
+
+			cmd.SilenceUsage = true
+
+			manager, err := agentConfigManager()
+			if err != nil {
+				return err
+			}
+
+			names, err := manager.ListScrapeConfigs()
+			if err != nil {
+				return err
+			}
+			sort.Strings(names)
+
+			var owned map[string]struct{}
+			if orphaned {
+				if owned, err = ownedConfigNames(cmd.Context()); err != nil {
+					return err
+				}
+			}
+
+			var targets []string
+			for _, name := range names {
+				if re != nil && !re.MatchString(name) {
+					continue
+				}
+
+				if _, isOwned := owned[name]; orphaned && isOwned {
+					continue
+				}
+
+				targets = append(targets, name)
+			}
+
+			out := cmd.OutOrStdout()
+			if len(targets) == 0 {
+				_, _ = fmt.Fprintln(out, "No configs to delete")
+				return nil
+			}
+
+			for _, name := range targets {
+				_, _ = fmt.Fprintln(out, name)
+			}
+
+			if viper.GetBool("dry-run") {
+				_, _ = fmt.Fprintf(out, "Would delete %d configs (dry run)\n", len(targets))
+				return nil
+			}
+
+			if !yes {
+				_, _ = fmt.Fprintf(out, "Delete %d configs? [y/N] ", len(targets))
+				answer, _ := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+				if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+					return fmt.Errorf("aborted")
+				}
+			}
+
+			failed := 0
+			for _, name := range targets {
+				err := manager.DeleteScrapeConfig(&instance.Config{Name: name})
+				if err != nil && !errors.Is(err, operator.ErrConfigNotFound) {
+					logrus.WithField("config", name).WithError(err).Error("Failed to delete config")
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("failed to delete %d of %d configs", failed, len(targets))
+			}
+
+			_, _ = fmt.Fprintf(out, "Deleted %d configs\n", len(targets))
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&match, "match", "", "Delete configs whose name matches this regular expression")
+	flags.BoolVar(&orphaned, "orphaned", false, "Delete configs that do not belong to any ServiceMonitor in the cluster")
+	flags.BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation before deleting")
+
+	return cmd
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrune(t *testing.T) {
+	setup := func(t *testing.T) *fakeAgent {
+		fakeCluster(t, []*monitoringv1.ServiceMonitor{{
+			ObjectMeta: metav1.ObjectMeta{Name: "live", Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}}},
+		}})
+
+		return newFakeAgent(t,
+			&instance.Config{Name: "myapp/live/0"},
+			&instance.Config{Name: "myapp/live/1"},
+			&instance.Config{Name: "myapp/removed/0"},
+			&instance.Config{Name: "other/removed/0"},
+			&instance.Config{Name: "hand-made"},
+		)
+	}
+
+	t.Run("Requires A Filter", func(t *testing.T) {
+		agent := setup(t)
+
+		_, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "-y")
+		require.EqualError(t, err, "at least one of --match or --orphaned is required")
+		assert.Empty(t, agent.Deleted())
+	})
+
+	t.Run("Orphaned", func(t *testing.T) {
+		agent := setup(t)
+
+		out, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "--orphaned", "-y")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"hand-made", "myapp/live/1", "myapp/removed/0", "other/removed/0"}, agent.Deleted())
+		assert.Contains(t, out, "Deleted 4 configs")
+	})
+
+	t.Run("Match", func(t *testing.T) {
+		agent := setup(t)
+
+		newMonitoringClient = func() (versioned.Interface, error) {
+			t.Error("only --orphaned needs the cluster")
+			return nil, errors.New("no cluster")
+		}
+
+		_, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "--match", "^myapp/", "-y")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"myapp/live/0", "myapp/live/1", "myapp/removed/0"}, agent.Deleted())
+	})
+
+	t.Run("Match And Orphaned", func(t *testing.T) {
+		agent := setup(t)
+
+		_, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "--match", "^myapp/", "--orphaned", "-y")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"myapp/live/1", "myapp/removed/0"}, agent.Deleted())
+	})
+
+	t.Run("Nothing To Delete", func(t *testing.T) {
+		agent := setup(t)
+
+		out, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "--match", "^unknown/")
+		require.NoError(t, err)
+		assert.Equal(t, "No configs to delete\n", out)
+		assert.Empty(t, agent.Deleted())
+	})
+
+	t.Run("Confirmed", func(t *testing.T) {
+		agent := setup(t)
+
+		out, err := runCommand(t, "yes\n", "prune", "--agent-url", agent.URL, "--match", "^other/")
+		require.NoError(t, err)
+		assert.Contains(t, out, "Delete 1 configs? [y/N]")
+		assert.Equal(t, []string{"other/removed/0"}, agent.Deleted())
+	})
+
+	t.Run("Aborted", func(t *testing.T) {
+		for _, answer := range []string{"n\n", "\n", ""} {
+			agent := setup(t)
+
+			out, err := runCommand(t, answer, "prune", "--agent-url", agent.URL, "--orphaned")
+			require.EqualError(t, err, "aborted")
+			assert.Contains(t, out, "Delete 4 configs? [y/N]")
+			assert.Empty(t, agent.Deleted(), "deleted configs after answering %q", answer)
+		}
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		agent := setup(t)
+
+		out, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "--orphaned", "--dry-run")
+		require.NoError(t, err)
+		assert.Equal(t, "hand-made\nmyapp/live/1\nmyapp/removed/0\nother/removed/0\nWould delete 4 configs (dry run)\n", out)
+		assert.Empty(t, agent.Deleted())
+	})
+
+	t.Run("Cluster Unavailable", func(t *testing.T) {
+		agent := setup(t)
+		newMonitoringClient = func() (versioned.Interface, error) {
+			return nil, errors.New("no cluster")
+		}
+
+		_, err := runCommand(t, "", "prune", "--agent-url", agent.URL, "--orphaned", "-y")
+		require.EqualError(t, err, "no cluster")
+		assert.Empty(t, agent.Deleted(), "configs were deleted without knowing which are orphaned")
+	})
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/mattn/go-colorable"
+	"github.com/nlowe/grafana-agent-operator/k8sutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewRenderCmd() *cobra.Command {
+	var files []string
+	var namespace string
+
+	cmd := &cobra.Command{
+		Use:   "render -f servicemonitor.yaml",
+		Short: "renders ServiceMonitors to agent instance configs",
+		Long: "Reads ServiceMonitors from the specified manifests and prints the instance configs the operator " +
+			"would sync with the agent, without connecting to an agent. Only connects to the cluster to look up " +
+			"Namespaces when --namespace-labels is set.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			logToStderr()
+
+			sms, err := k8sutil.ReadServiceMonitors(files...)
+			if err != nil {
+				return err
+			}
+
+			namespaces, err := listNamespaces(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			writer, err := offlineConfigWriter(namespaces)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			first := true
+			invalid := 0
+			for _, sm := range sms {
+				if sm.Namespace == "" {
+					sm.Namespace = namespace
+				}
+
+				log := logrus.WithField("serviceMonitor", sm.Namespace+"/"+sm.Name)
+				if err := writer.Validate(sm); err != nil {
+					log.WithError(err).Error("Invalid ServiceMonitor, the operator would not sync it")
+					invalid++
+					continue
+				}
+
+				cfgs, warnings, err := writer.ScrapeConfigsForServiceMonitor(sm)
+				if err != nil {
+					return fmt.Errorf("failed to render %s/%s: %w", sm.Namespace, sm.Name, err)
+				}
+
+				for _, warning := range warnings {
+					log.Warn(warning)
+				}
+
+				for _, cfg := range cfgs {
+					raw, err := instance.MarshalConfig(cfg, false)
+					if err != nil {
+						return fmt.Errorf("failed to marshal %s: %w", cfg.Name, err)
+					}
+
+					if !first {
+						_, _ = fmt.Fprintln(out, "---")
+					}
+					first = false
+
+					_, _ = out.Write(raw)
+				}
+			}
+
+			if invalid > 0 {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("%d of %d ServiceMonitors are invalid", invalid, len(sms))
+			}
+
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&files, "filename", "f", nil, "Files or directories containing ServiceMonitors to render, - for stdin")
+	flags.StringVarP(&namespace, "namespace", "n", "default", "The namespace to use for ServiceMonitors that do not specify one")
+	_ = cmd.MarkFlagRequired("filename")
+
+	return cmd
+}
+
+// logToStderr keeps log messages out of the output of commands that print results to stdout
+func logToStderr() {
+	logrus.SetOutput(colorable.NewColorableStderr())
+}
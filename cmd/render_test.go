@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/render/servicemonitor.golden.yaml")
+	require.NoError(t, err)
+
+	t.Run("Valid", func(t *testing.T) {
+		out, err := runCommand(t, "", "render", "-f", "testdata/render/servicemonitor.yaml")
+		require.NoError(t, err)
+		assert.Equal(t, string(golden), out, "update testdata/render/servicemonitor.golden.yaml if the change is intended")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		defer hook.Reset()
+
+		out, err := runCommand(t, "", "render", "-f", "testdata/render/invalid.yaml", "-f", "testdata/render/servicemonitor.yaml")
+		require.EqualError(t, err, "1 of 2 ServiceMonitors are invalid")
+		assert.Equal(t, string(golden), out, "valid ServiceMonitors were not rendered")
+
+		var reported *logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["serviceMonitor"] == "myapp/invalid" {
+				reported = entry
+			}
+		}
+
+		require.NotNil(t, reported, "the invalid ServiceMonitor was not reported")
+		assert.Equal(t, logrus.ErrorLevel, reported.Level)
+		assert.Contains(t, reported.Data[logrus.ErrorKey].(error).Error(), `spec.endpoints[0].interval: Invalid value: "soon"`)
+		assert.Contains(t, reported.Data[logrus.ErrorKey].(error).Error(), `spec.endpoints[0].port: Invalid value: "web("`)
+	})
+
+	t.Run("Requires Files", func(t *testing.T) {
+		_, err := runCommand(t, "", "render")
+		require.EqualError(t, err, `required flag(s) "filename" not set`)
+	})
+}
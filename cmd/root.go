@@ -2,19 +2,18 @@ package cmd
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"runtime"
 	"time"
 
+	"github.com/nlowe/grafana-agent-operator/config"
 	"github.com/nlowe/grafana-agent-operator/operator"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
 )
 
 func NewRootCmd() *cobra.Command {
@@ -25,7 +24,12 @@ func NewRootCmd() *cobra.Command {
 			"in Scraping Service mode. Each discovered ServiceMonitor Endpoint will result in a config for the " +
 			"agents to maximize sharding.",
 		Args: cobra.NoArgs,
-		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			if err := loadSettings(cmd.Root().PersistentFlags()); err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+
 			lvl, err := logrus.ParseLevel(viper.GetString("verbosity"))
 			if err != nil {
 				return err
@@ -34,27 +38,8 @@ func NewRootCmd() *cobra.Command {
 			logrus.SetLevel(lvl)
 			return nil
 		},
-		RunE: func(_ *cobra.Command, _ []string) error {
-			var cfg *rest.Config
-			var err error
-
-			if viper.GetBool("in-cluster") {
-				logrus.Info("Running in-cluster")
-				cfg, err = rest.InClusterConfig()
-			} else {
-				kubecfg := filepath.Join(homedir.HomeDir(), ".kube", "config")
-				if p, set := os.LookupEnv("KUBECONFG"); set {
-					kubecfg = p
-				}
-
-				if _, stat := os.Stat(kubecfg); os.IsNotExist(stat) {
-					logrus.WithField("kubeconfig", kubecfg).Fatal("Config file not found")
-				}
-
-				logrus.WithField("kubeconfig", kubecfg).Info("Using config file")
-				cfg, err = clientcmd.BuildConfigFromFlags("", kubecfg)
-			}
-
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := restConfig()
 			if err != nil {
 				return err
 			}
@@ -63,10 +48,28 @@ func NewRootCmd() *cobra.Command {
 
 			// TODO: k8s connectivity checks
 			// TODO: grafana-agent connectivity checks
-			if agentUrl := viper.GetString("agent-url"); agentUrl == "" {
-				logrus.Warn("--agent-url not specified, cannot sync with grafana-agent")
+			if manager, err := newConfigManager(); err != nil {
+				return err
+			} else if manager == nil {
+				logrus.Warn("--agent-url, --agent-config-file or --agent-config-map not specified, cannot sync with grafana-agent")
 			} else {
-				cfgManager = operator.NewGrafanaAgentConfigManager(agentUrl)
+				cfgManager = manager
+			}
+
+			if cfgManager, err = dryRunConfigManager(cfgManager); err != nil {
+				return err
+			}
+
+			if addr := viper.GetString("metrics-listen-address"); addr != "" {
+				go func() {
+					mux := http.NewServeMux()
+					mux.Handle("/metrics", promhttp.Handler())
+
+					logrus.WithField("address", addr).Info("Serving metrics")
+					if err := http.ListenAndServe(addr, mux); err != nil {
+						logrus.WithError(err).Error("Failed to serve metrics")
+					}
+				}()
 			}
 
 			ctx, cancel := context.WithCancel(context.Background())
@@ -78,6 +81,18 @@ func NewRootCmd() *cobra.Command {
 					return err
 				}
 
+				if viper.ConfigFileUsed() != "" {
+					watchConfigFile(cmd.Root().PersistentFlags(), controller)
+				}
+
+				// Stays nil without the webhook, so it never fails
+				var webhookFailed <-chan error
+				if viper.GetString("webhook-listen-address") != "" {
+					if webhookFailed, err = serveWebhook(ctx, controller); err != nil {
+						return err
+					}
+				}
+
 				go func() {
 					c := make(chan os.Signal, 1)
 					signal.Notify(c, os.Interrupt)
@@ -87,24 +102,97 @@ func NewRootCmd() *cobra.Command {
 					logrus.Info("Shutting Down")
 				}()
 
-				return controller.Run(ctx)
+				stopped := make(chan error, 1)
+				go func() {
+					stopped <- controller.Run(ctx)
+				}()
+
+				select {
+				case err := <-stopped:
+					return err
+				case err := <-webhookFailed:
+					logrus.WithError(err).Error("Shutting down, the webhook is no longer served")
+					cancel()
+					<-stopped
+					return err
+				}
 			}()
 		},
 	}
 
 	flags := cmd.PersistentFlags()
 
+	flags.String("config", "", "A YAML file containing settings, keyed by flag name. Environment variables prefixed with "+envPrefix+"_ override the file, flags override both")
 	flags.String("verbosity", "info", "Verbosity to log at [fatal, error, warning, info, debug, trace]")
 
 	flags.Bool("in-cluster", false, "Use the in-cluster token to talk to kubernetes")
+	flags.String("kubeconfig", "", "The kubeconfig file to use when not running in-cluster, defaults to the files in $KUBECONFIG or ~/.kube/config")
+	flags.String("context", "", "The kubeconfig context to use, defaults to the current context")
+	flags.Float32("kube-qps", 5, "The maximum queries per second to the kubernetes API server")
+	flags.Int("kube-burst", 10, "The maximum burst of queries to the kubernetes API server")
 	flags.String("agent-url", "", "The API Endpoint to write instance configuration to")
+	flags.Int("agent-retries", 3, "How many times to retry requests to the agent that fail with a connection error or a 5xx status code")
+	flags.Duration("agent-retry-min-backoff", 250*time.Millisecond, "How long to wait before the first retry of a failed request to the agent, doubling with each retry")
+	flags.Duration("agent-retry-max-backoff", 5*time.Second, "The longest time to wait between retries of a failed request to the agent")
+	flags.Int("agent-breaker-threshold", 5, "Stop sending requests to the agent after this many consecutive failures, 0 to disable")
+	flags.Duration("agent-breaker-cooldown", 30*time.Second, "How long to stop sending requests to the agent once the breaker opens")
+	flags.String("agent-config-file", "", "Write instance configs to this agent config file instead of --agent-url, for agents running as a DaemonSet")
+	flags.String("agent-config-map", "", "Write instance configs to the agent config file in this namespace/name ConfigMap instead of --agent-url, for agents running as a DaemonSet")
+	flags.String("agent-config-map-key", "agent.yaml", "The key of the agent config file in --agent-config-map")
+	flags.Bool("host-filter", false, "Enable host_filter in every instance config so agents running as a DaemonSet only scrape targets on their node")
+	flags.StringSlice("static-labels", nil, "name=value labels to add to every target, for example cluster=prod-eu-1")
+	flags.StringSlice("namespace-labels", nil, "name=key labels to add to every target, copied from the label with that key on the Namespace of the target")
+	flags.String("label-conflict-policy", string(config.LabelConflictOverride), "What to do when a ServiceMonitor sets a static or namespace label itself [override, keep, reject]")
 	flags.String("remote-write-url", "http://cortex.monitoring.svc.cluster.local/api/prom/push", "The URL to use for remote-write")
 	flags.String("remote-write-config", "", "The path to a file containing the remote_write config to use")
 
+	flags.String("discovery-role", "endpoints", "The kubernetes service discovery role to find targets with [endpoints, endpointslice]")
+	flags.Bool("sd-selector-pushdown", true, "Pass ServiceMonitor selectors to kubernetes service discovery, which only discovers Endpoints whose own labels match the selector")
+	flags.String("sd-api-server", "", "The kubernetes API server the agents should discover targets from, if they do not run in this cluster")
+	flags.String("sd-api-server-ca-file", "", "The CA certificate file on the agents to verify --sd-api-server with")
+	flags.String("sd-api-server-cert-file", "", "The client certificate file on the agents to authenticate to --sd-api-server with")
+	flags.String("sd-api-server-key-file", "", "The client key file on the agents to authenticate to --sd-api-server with")
+	flags.String("sd-api-server-server-name", "", "The server name to verify the certificate of --sd-api-server against")
+	flags.Bool("sd-api-server-insecure-skip-verify", false, "Do not verify the certificate of --sd-api-server")
+	flags.String("sd-api-server-bearer-token-file", "", "The bearer token file on the agents to authenticate to --sd-api-server with")
+	flags.String("sd-token-service-account", "", "A namespace/name ServiceAccount to mint bearer tokens for --sd-api-server from")
+	flags.Duration("sd-token-ttl", 1*time.Hour, "How long the tokens minted for --sd-token-service-account are valid for")
+	flags.Duration("default-scrape-interval", 0, "The scrape interval to use for endpoints that do not specify one, 0 uses the agent default")
+	flags.Duration("default-scrape-timeout", 0, "The scrape timeout to use for endpoints that do not specify one, 0 uses the agent default")
+	flags.Duration("min-scrape-interval", 0, "The shortest scrape interval an endpoint may request, 0 for no limit")
+	flags.Uint("max-sample-limit", 0, "The largest sampleLimit a ServiceMonitor may request, 0 for no limit. Label limits are not supported by the agent")
+	flags.Uint("max-target-limit", 0, "The largest targetLimit a ServiceMonitor may request, 0 for no limit. Label limits are not supported by the agent")
+	flags.Duration("wal-truncate-frequency", 0, "How often each generated instance truncates its WAL, 0 uses the agent default")
+	flags.Duration("min-wal-time", 0, "The minimum amount of time series are kept in the WAL of each generated instance, 0 uses the agent default")
+	flags.Duration("max-wal-time", 0, "The maximum amount of time series are kept in the WAL of each generated instance, 0 uses the agent default")
+	flags.Duration("remote-flush-deadline", 0, "How long each generated instance waits for remote write to flush when it stops, 0 uses the agent default")
+	flags.Bool("write-stale-on-shutdown", false, "Write staleness markers for all series when a generated instance stops")
+
+	flags.Bool("record-status", true, "Record the sync status of each ServiceMonitor in annotations on the ServiceMonitor")
+
+	flags.Bool("finalizers", false, "Add a finalizer to each ServiceMonitor to guarantee its configs are deleted from the agent")
+
+	flags.Duration("drift-interval", 10*time.Minute, "How often to compare the configs in the agent with the desired configs, 0 to disable")
+	flags.Bool("dry-run", false, "Read from the agent but only log the changes that would be made to it and to ServiceMonitors")
+	flags.String("dry-run-output", "", "A file to append the configs that would be updated or deleted to when running with --dry-run")
+	flags.Bool("drift-dry-run", false, "Only log config drift instead of correcting it")
+	flags.String("metrics-listen-address", ":8080", "The address to serve prometheus metrics on, empty to disable")
+	flags.String("webhook-listen-address", "", "The address to serve the validating admission webhook for ServiceMonitors on, empty to disable")
+	flags.String("webhook-cert-file", "", "The TLS certificate file to serve the webhook with")
+	flags.String("webhook-key-file", "", "The TLS key file to serve the webhook with")
+	flags.Duration("webhook-cert-reload-interval", 1*time.Minute, "How often to check the webhook certificate and key files for changes")
+	flags.Bool("webhook-warn-only", false, "Admit invalid ServiceMonitors with warnings instead of rejecting them")
+
 	flags.Int("parallelism", runtime.NumCPU(), "The number of worker goroutines to start")
 	flags.Duration("relist", 1*time.Minute, "How often to re-list ServiceMonitors")
 
 	_ = viper.BindPFlags(flags)
+	bindEnv(viper.GetViper())
+
+	cmd.AddCommand(NewRenderCmd())
+	cmd.AddCommand(NewDiffCmd())
+	cmd.AddCommand(NewListCmd())
+	cmd.AddCommand(NewPruneCmd())
 
 	return cmd
 }
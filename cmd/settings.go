@@ -0,0 +1,385 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	"github.com/nlowe/grafana-agent-operator/operator"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const envPrefix = "GAO"
+
+// reloadableSettings can be changed in the config file without restarting the operator. Changes to any other
+// setting are only picked up after a restart.
+var reloadableSettings = []string{
+	"verbosity",
+	"remote-write-url",
+	"discovery-role",
+	"sd-selector-pushdown",
+	"sd-api-server",
+	"sd-api-server-ca-file",
+	"sd-api-server-cert-file",
+	"sd-api-server-key-file",
+	"sd-api-server-server-name",
+	"sd-api-server-insecure-skip-verify",
+	"sd-api-server-bearer-token-file",
+	"default-scrape-interval",
+	"default-scrape-timeout",
+	"min-scrape-interval",
+	"max-sample-limit",
+	"max-target-limit",
+	"host-filter",
+	"static-labels",
+	"label-conflict-policy",
+	"wal-truncate-frequency",
+	"min-wal-time",
+	"max-wal-time",
+	"remote-flush-deadline",
+	"write-stale-on-shutdown",
+}
+
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+}
+
+// loadSettings reads the config file, if one was specified, and validates the resulting settings
+func loadSettings(flags *pflag.FlagSet) error {
+	if path := viper.GetString("config"); path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		if err := checkConfigFileKeys(path, raw, flags); err != nil {
+			return err
+		}
+
+		viper.SetConfigFile(path)
+		if err := viper.ReadConfig(bytes.NewReader(raw)); err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+
+	return validateSettings(viper.GetViper(), flags)
+}
+
+// checkConfigFileKeys ensures every key in raw, the contents of the config file at path, corresponds to a setting
+// so typos are not silently ignored
+func checkConfigFileKeys(path string, raw []byte, flags *pflag.FlagSet) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var unknown []string
+	for _, key := range v.AllKeys() {
+		if key == "config" || flags.Lookup(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// validateSettings checks that every setting in v can be parsed as the type of its flag and that the settings are
+// consistent with each other
+func validateSettings(v *viper.Viper, flags *pflag.FlagSet) error {
+	var problems []string
+	invalid := map[string]struct{}{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		var err error
+		value := v.Get(f.Name)
+
+		switch f.Value.Type() {
+		case "bool":
+			_, err = cast.ToBoolE(value)
+		case "duration":
+			var d time.Duration
+			if d, err = cast.ToDurationE(value); err == nil && d < 0 {
+				err = fmt.Errorf("must not be negative, got %s", d)
+			}
+		case "int":
+			_, err = cast.ToIntE(value)
+		case "float32":
+			_, err = cast.ToFloat32E(value)
+		case "uint":
+			_, err = cast.ToUintE(value)
+		}
+
+		if err != nil {
+			invalid[f.Name] = struct{}{}
+			problems = append(problems, fmt.Sprintf("%s: %v", f.Name, err))
+		}
+	})
+
+	check := func(key string, ok bool, format string, args ...interface{}) {
+		if _, skip := invalid[key]; !skip && !ok {
+			problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, err := logrus.ParseLevel(v.GetString("verbosity"))
+	check("verbosity", err == nil, "%v", err)
+
+	for _, key := range []string{"agent-url", "remote-write-url", "sd-api-server"} {
+		raw := v.GetString(key)
+		if raw == "" {
+			continue
+		}
+
+		u, err := url.Parse(raw)
+		if err != nil {
+			check(key, false, "%v", err)
+		} else {
+			check(key, u.Scheme == "http" || u.Scheme == "https", "must be an http or https URL, got '%s'", raw)
+		}
+	}
+
+	check("remote-write-url", v.GetString("remote-write-url") != "", "must be set")
+
+	targets := 0
+	for _, key := range []string{"agent-url", "agent-config-file", "agent-config-map"} {
+		if v.GetString(key) != "" {
+			targets++
+		}
+	}
+	check("agent-url", targets <= 1, "only one of agent-url, agent-config-file and agent-config-map may be set")
+
+	if cm := v.GetString("agent-config-map"); cm != "" {
+		parts := strings.Split(cm, "/")
+		check("agent-config-map", len(parts) == 2 && parts[0] != "" && parts[1] != "", "must be namespace/name, got '%s'", cm)
+		check("agent-config-map-key", v.GetString("agent-config-map-key") != "", "must be set")
+	}
+
+	staticLabels, err := config.ParseLabelPairs(v.GetStringSlice("static-labels"))
+	check("static-labels", err == nil, "%v", err)
+	for name := range staticLabels {
+		err := config.ValidateStaticLabelName(name)
+		check("static-labels", err == nil, "%v", err)
+	}
+
+	namespaceLabels, err := config.ParseLabelPairs(v.GetStringSlice("namespace-labels"))
+	check("namespace-labels", err == nil, "%v", err)
+	for name, key := range namespaceLabels {
+		err := config.ValidateStaticLabelName(name)
+		check("namespace-labels", err == nil, "%v", err)
+
+		errs := validation.IsQualifiedName(key)
+		check("namespace-labels", len(errs) == 0, "'%s' is not a valid label key: %s", key, strings.Join(errs, ", "))
+
+		_, static := staticLabels[name]
+		check("namespace-labels", !static, "'%s' is also set in static-labels", name)
+	}
+
+	policy := v.GetString("label-conflict-policy")
+	check(
+		"label-conflict-policy", contains(config.LabelConflictPolicies, policy),
+		"must be one of %s, got '%s'", strings.Join(config.LabelConflictPolicies, ", "), policy,
+	)
+
+	role := v.GetString("discovery-role")
+	check("discovery-role", role == "endpoints" || role == "endpointslice", "must be endpoints or endpointslice, got '%s'", role)
+
+	check(
+		"sd-api-server-key-file", (v.GetString("sd-api-server-cert-file") == "") == (v.GetString("sd-api-server-key-file") == ""),
+		"must be set together with sd-api-server-cert-file",
+	)
+
+	if sa := v.GetString("sd-token-service-account"); sa != "" {
+		parts := strings.Split(sa, "/")
+		check("sd-token-service-account", len(parts) == 2 && parts[0] != "" && parts[1] != "", "must be namespace/name, got '%s'", sa)
+		check("sd-token-service-account", v.GetString("sd-api-server") != "", "requires sd-api-server")
+		check("sd-token-service-account", v.GetString("sd-api-server-bearer-token-file") == "", "cannot be used with sd-api-server-bearer-token-file")
+
+		ttl := v.GetDuration("sd-token-ttl")
+		check("sd-token-ttl", ttl >= 10*time.Minute, "must be at least 10m, got %s", ttl)
+	}
+
+	if v.GetString("webhook-listen-address") != "" {
+		check("webhook-cert-file", v.GetString("webhook-cert-file") != "", "required to serve the webhook")
+		check("webhook-key-file", v.GetString("webhook-key-file") != "", "required to serve the webhook")
+
+		reload := v.GetDuration("webhook-cert-reload-interval")
+		check("webhook-cert-reload-interval", reload > 0, "must be greater than 0, got %s", reload)
+	}
+
+	p := v.GetInt("parallelism")
+	check("parallelism", p > 0, "must be greater than 0, got %d", p)
+
+	qps := v.GetFloat64("kube-qps")
+	check("kube-qps", qps > 0, "must be greater than 0, got %v", qps)
+
+	burst := v.GetInt("kube-burst")
+	check("kube-burst", burst > 0, "must be greater than 0, got %d", burst)
+
+	retries := v.GetInt("agent-retries")
+	check("agent-retries", retries >= 0, "must not be negative, got %d", retries)
+
+	minBackoff, maxBackoff := v.GetDuration("agent-retry-min-backoff"), v.GetDuration("agent-retry-max-backoff")
+	check(
+		"agent-retry-min-backoff", minBackoff <= maxBackoff,
+		"%s must not be greater than agent-retry-max-backoff %s", minBackoff, maxBackoff,
+	)
+
+	threshold := v.GetInt("agent-breaker-threshold")
+	check("agent-breaker-threshold", threshold >= 0, "must not be negative, got %d", threshold)
+
+	r := v.GetDuration("relist")
+	check("relist", r > 0, "must be greater than 0, got %s", r)
+
+	interval, timeout := v.GetDuration("default-scrape-interval"), v.GetDuration("default-scrape-timeout")
+	check(
+		"default-scrape-timeout", interval == 0 || timeout <= interval,
+		"%s must not be greater than default-scrape-interval %s", timeout, interval,
+	)
+
+	minInterval := v.GetDuration("min-scrape-interval")
+	check(
+		"default-scrape-interval", interval == 0 || interval >= minInterval,
+		"%s must not be less than min-scrape-interval %s", interval, minInterval,
+	)
+
+	// Unset WAL settings use the agent defaults, which the other settings have to be compatible with
+	minWAL, maxWAL := v.GetDuration("min-wal-time"), v.GetDuration("max-wal-time")
+	if minWAL == 0 {
+		minWAL = instance.DefaultConfig.MinWALTime
+	}
+	if maxWAL == 0 {
+		maxWAL = instance.DefaultConfig.MaxWALTime
+	}
+	check("min-wal-time", minWAL <= maxWAL, "%s must not be greater than max-wal-time %s", minWAL, maxWAL)
+
+	truncate := v.GetDuration("wal-truncate-frequency")
+	if truncate == 0 {
+		truncate = instance.DefaultConfig.WALTruncateFrequency
+	}
+	check(
+		"default-scrape-interval", interval <= truncate,
+		"%s must not be greater than wal-truncate-frequency %s", interval, truncate,
+	)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid settings:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restartRequired returns the settings that changed between two snapshots of viper.AllSettings() that cannot
+// be reloaded
+func restartRequired(before, after map[string]interface{}) []string {
+	reloadable := map[string]struct{}{}
+	for _, key := range reloadableSettings {
+		reloadable[key] = struct{}{}
+	}
+
+	var result []string
+	for key, v := range after {
+		if _, ok := reloadable[key]; ok {
+			continue
+		}
+
+		if fmt.Sprint(before[key]) != fmt.Sprint(v) {
+			result = append(result, key)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// watchConfigFile applies changes to the reloadable settings in the config file to the controller
+func watchConfigFile(flags *pflag.FlagSet, controller *operator.Controller) {
+	path := viper.ConfigFileUsed()
+	log := logrus.WithField("config", path)
+	applied := viper.AllSettings()
+
+	// The live settings are only updated once a change is known to be valid, so the file is watched separately
+	watcher := viper.New()
+	watcher.SetConfigFile(path)
+	watcher.OnConfigChange(func(_ fsnotify.Event) {
+		settings, err := applyConfigFile(path, flags)
+		if err != nil {
+			log.WithError(err).Error("Ignoring invalid config file change")
+			return
+		}
+
+		if changed := restartRequired(applied, settings); len(changed) > 0 {
+			log.WithField("settings", changed).Warn("Restart the operator to apply changes to these settings")
+		}
+		applied = settings
+
+		lvl, _ := logrus.ParseLevel(viper.GetString("verbosity"))
+		logrus.SetLevel(lvl)
+
+		if err := controller.Reload(); err != nil {
+			log.WithError(err).Error("Failed to reload settings")
+		}
+	})
+
+	log.Info("Watching config file for changes")
+	watcher.WatchConfig()
+}
+
+// applyConfigFile validates the config file at path in a separate viper instance with the same flags and
+// environment variables as the live settings, and only replaces the live settings from the config file if the
+// result is valid. It returns the new settings.
+func applyConfigFile(path string, flags *pflag.FlagSet) (map[string]interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := checkConfigFileKeys(path, raw, flags); err != nil {
+		return nil, err
+	}
+
+	candidate := viper.New()
+	_ = candidate.BindPFlags(flags)
+	bindEnv(candidate)
+	candidate.SetConfigFile(path)
+	if err := candidate.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := validateSettings(candidate, flags); err != nil {
+		return nil, err
+	}
+
+	if err := viper.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	return viper.AllSettings(), nil
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlowe/grafana-agent-operator/operator"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+	return path
+}
+
+func TestLoadSettings(t *testing.T) {
+	setup := func(t *testing.T, configFile string) error {
+		viper.Reset()
+		cmd := NewRootCmd()
+		require.NoError(t, cmd.PersistentFlags().Set("config", configFile))
+
+		return loadSettings(cmd.PersistentFlags())
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		require.NoError(t, setup(t, ""))
+	})
+
+	t.Run("Config File", func(t *testing.T) {
+		require.NoError(t, setup(t, writeConfigFile(t, "agent-url: http://agent:8080\nmax-sample-limit: 1000\n")))
+
+		assert.Equal(t, "http://agent:8080", viper.GetString("agent-url"))
+		assert.Equal(t, uint(1000), viper.GetUint("max-sample-limit"))
+	})
+
+	t.Run("Environment Overrides Config File", func(t *testing.T) {
+		require.NoError(t, os.Setenv("GAO_MAX_SAMPLE_LIMIT", "500"))
+		defer func() {
+			_ = os.Unsetenv("GAO_MAX_SAMPLE_LIMIT")
+		}()
+
+		require.NoError(t, setup(t, writeConfigFile(t, "max-sample-limit: 1000\n")))
+		assert.Equal(t, uint(500), viper.GetUint("max-sample-limit"))
+	})
+
+	t.Run("Unknown Settings", func(t *testing.T) {
+		path := writeConfigFile(t, "agent-uri: http://agent:8080\nparallelism: 4\nnested:\n  key: value\n")
+		require.EqualError(t, setup(t, path), path+": unknown settings: agent-uri, nested.key")
+	})
+
+	t.Run("Invalid Settings", func(t *testing.T) {
+		err := setup(t, writeConfigFile(t, `
+verbosity: loud
+agent-url: ftp://agent
+parallelism: 0
+relist: soon
+max-sample-limit: -1
+default-scrape-interval: 10s
+default-scrape-timeout: 30s
+min-scrape-interval: 1m
+min-wal-time: 5h
+agent-config-map: agent-config
+static-labels: [__cluster=prod]
+namespace-labels: [team=example.com/team/name]
+label-conflict-policy: merge
+webhook-listen-address: ":8443"
+webhook-key-file: /etc/webhook/tls.key
+`))
+
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "verbosity: not a valid logrus Level")
+		assert.Contains(t, err.Error(), "agent-url: must be an http or https URL, got 'ftp://agent'")
+		assert.Contains(t, err.Error(), "parallelism: must be greater than 0, got 0")
+		assert.Contains(t, err.Error(), "relist: time: invalid duration")
+		assert.NotContains(t, err.Error(), "relist: must be greater than 0")
+		assert.Contains(t, err.Error(), "max-sample-limit: unable to cast negative value")
+		assert.Contains(t, err.Error(), "default-scrape-timeout: 30s must not be greater than default-scrape-interval 10s")
+		assert.Contains(t, err.Error(), "default-scrape-interval: 10s must not be less than min-scrape-interval 1m0s")
+		assert.Contains(t, err.Error(), "min-wal-time: 5h0m0s must not be greater than max-wal-time 4h0m0s")
+		assert.Contains(t, err.Error(), "agent-url: only one of agent-url, agent-config-file and agent-config-map may be set")
+		assert.Contains(t, err.Error(), "agent-config-map: must be namespace/name, got 'agent-config'")
+		assert.Contains(t, err.Error(), "static-labels: '__cluster' uses the reserved __ prefix")
+		assert.Contains(t, err.Error(), "namespace-labels: 'example.com/team/name' is not a valid label key")
+		assert.Contains(t, err.Error(), "label-conflict-policy: must be one of override, keep, reject, got 'merge'")
+		assert.Contains(t, err.Error(), "webhook-cert-file: required to serve the webhook")
+		assert.NotContains(t, err.Error(), "webhook-key-file")
+	})
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	path := writeConfigFile(t, "remote-write-url: http://cortex-a/api/prom/push\nmax-sample-limit: 1000\n")
+	cmd := NewRootCmd()
+	flags := cmd.PersistentFlags()
+	require.NoError(t, flags.Set("config", path))
+	require.NoError(t, loadSettings(flags))
+
+	// Rebuilds the writer from the live settings, like Controller.Reload does
+	reload := func() string {
+		writer, err := operator.NewConfigWriter()
+		require.NoError(t, err)
+
+		cfgs, _, err := writer.ScrapeConfigsForServiceMonitor(&monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}}},
+		})
+		require.NoError(t, err)
+
+		return cfgs[0].RemoteWrite[0].Base.URL.String()
+	}
+
+	t.Run("Invalid Change", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(path, []byte("remote-write-url: http://cortex-b/api/prom/push\nmax-sample-limit: -1\n"), 0600))
+
+		_, err := applyConfigFile(path, flags)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "max-sample-limit")
+
+		assert.Equal(t, uint(1000), viper.GetUint("max-sample-limit"), "invalid change was applied")
+		assert.Equal(t, "http://cortex-a/api/prom/push", reload(), "reload picked up the invalid change")
+	})
+
+	t.Run("Unknown Settings", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(path, []byte("remote-write-url: http://cortex-b/api/prom/push\nmax-sample-limt: 10\n"), 0600))
+
+		_, err := applyConfigFile(path, flags)
+		require.EqualError(t, err, path+": unknown settings: max-sample-limt")
+		assert.Equal(t, "http://cortex-a/api/prom/push", reload(), "reload picked up the invalid change")
+	})
+
+	t.Run("Valid Change", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(path, []byte("remote-write-url: http://cortex-b/api/prom/push\n"), 0600))
+
+		settings, err := applyConfigFile(path, flags)
+		require.NoError(t, err)
+		assert.Equal(t, "http://cortex-b/api/prom/push", settings["remote-write-url"])
+
+		assert.Equal(t, "http://cortex-b/api/prom/push", reload())
+		assert.Zero(t, viper.GetUint("max-sample-limit"), "settings removed from the config file were kept")
+	})
+}
+
+func TestRestartRequired(t *testing.T) {
+	before := map[string]interface{}{"agent-url": "http://a", "verbosity": "info", "max-sample-limit": 10}
+	after := map[string]interface{}{"agent-url": "http://b", "verbosity": "debug", "max-sample-limit": 20}
+
+	assert.Equal(t, []string{"agent-url"}, restartRequired(before, after))
+	assert.Empty(t, restartRequired(before, before))
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/nlowe/grafana-agent-operator/httputil"
+	"github.com/nlowe/grafana-agent-operator/operator"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// webhookPath is the path the validating admission webhook is served at
+const webhookPath = "/validate-servicemonitor"
+
+// serveWebhook serves the validating admission webhook for ServiceMonitors on --webhook-listen-address until ctx
+// is done. The certificate is reloaded when it is rotated. Loading the certificate and binding the address happen
+// before it returns, and the returned channel receives the error if serving fails afterwards, since the API server
+// cannot admit ServiceMonitors through a webhook that is configured but not served.
+func serveWebhook(ctx context.Context, controller *operator.Controller) (<-chan error, error) {
+	addr := viper.GetString("webhook-listen-address")
+
+	certs, err := httputil.NewCertReloader(viper.GetString("webhook-cert-file"), viper.GetString("webhook-key-file"))
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for webhook requests: %w", err)
+	}
+
+	go certs.Run(ctx, viper.GetDuration("webhook-cert-reload-interval"))
+
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, controller.WebhookHandler(viper.GetBool("webhook-warn-only")))
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12},
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	failed := make(chan error, 1)
+	go func() {
+		log := logrus.WithField("address", listener.Addr().String()).WithField("path", webhookPath)
+		if viper.GetBool("webhook-warn-only") {
+			log = log.WithField("warnOnly", true)
+		}
+
+		log.Info("Serving validating admission webhook")
+		if err := server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+			failed <- fmt.Errorf("failed to serve validating admission webhook: %w", err)
+		}
+	}()
+
+	return failed, nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"net/url"
+
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/discovery/kubernetes"
+)
+
+// APIServer is the kubernetes API server the agents discover targets from. It is only needed when the agents do
+// not run in the cluster the ServiceMonitors are in. File paths are read by the agent, not the operator.
+type APIServer struct {
+	URL *url.URL
+
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+
+	BearerToken     string
+	BearerTokenFile string
+}
+
+// WithAPIServer makes every generated kubernetes SD config discover targets from the specified API server
+func WithAPIServer(a APIServer) Option {
+	return func(w *writer) {
+		w.apiServer = a
+	}
+}
+
+// WithAPIServerBearerToken authenticates to the API server configured with WithAPIServer using token
+func WithAPIServerBearerToken(token string) Option {
+	return func(w *writer) {
+		w.apiServer.BearerToken = token
+	}
+}
+
+func (a APIServer) apply(cfg *kubernetes.SDConfig) {
+	if a.URL == nil {
+		return
+	}
+
+	cfg.APIServer = commonconfig.URL{URL: a.URL}
+	cfg.HTTPClientConfig = commonconfig.HTTPClientConfig{
+		BearerToken:     commonconfig.Secret(a.BearerToken),
+		BearerTokenFile: a.BearerTokenFile,
+		TLSConfig: commonconfig.TLSConfig{
+			CAFile:             a.CAFile,
+			CertFile:           a.CertFile,
+			KeyFile:            a.KeyFile,
+			ServerName:         a.ServerName,
+			InsecureSkipVerify: a.InsecureSkipVerify,
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Diff returns a unified diff of the normalized config stored in the agent against the desired config, or an
+// empty string if they are equivalent. Either config may be nil if it does not exist.
+func Diff(name string, live, desired *instance.Config) (string, error) {
+	from, fromFile, err := diffSide(live, "agent/"+name)
+	if err != nil {
+		return "", err
+	}
+
+	to, toFile, err := diffSide(desired, "desired/"+name)
+	if err != nil {
+		return "", err
+	}
+
+	if from == to {
+		return "", nil
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from),
+		B:        difflib.SplitLines(to),
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  3,
+	})
+}
+
+func diffSide(cfg *instance.Config, file string) (string, string, error) {
+	if cfg == nil {
+		return "", "/dev/null", nil
+	}
+
+	normalized, err := Normalize(cfg)
+	return normalized, file, err
+}
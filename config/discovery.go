@@ -0,0 +1,51 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/kubernetes"
+)
+
+const endpointLabelPrefix = "__meta_kubernetes_endpoint_"
+
+// endpointSliceLabels maps the meta labels of the endpoints role used in generated relabel rules to their
+// equivalent for the endpointslice role
+var endpointSliceLabels = map[model.LabelName]model.LabelName{
+	"__meta_kubernetes_endpoint_port_name":           "__meta_kubernetes_endpointslice_port_name",
+	"__meta_kubernetes_endpoint_port_number":         "__meta_kubernetes_endpointslice_port",
+	"__meta_kubernetes_endpoint_port_protocol":       "__meta_kubernetes_endpointslice_port_protocol",
+	"__meta_kubernetes_endpoint_address_target_kind": "__meta_kubernetes_endpointslice_address_target_kind",
+	"__meta_kubernetes_endpoint_address_target_name": "__meta_kubernetes_endpointslice_address_target_name",
+	"__meta_kubernetes_endpoint_ready":               "__meta_kubernetes_endpointslice_endpoint_conditions_ready",
+	"__meta_kubernetes_endpoint_hostname":            "__meta_kubernetes_endpointslice_endpoint_hostname",
+}
+
+// WithDiscoveryRole discovers targets using the specified kubernetes SD role, which must be either
+// kubernetes.RoleEndpoint (the default) or kubernetes.RoleEndpointSlice
+func WithDiscoveryRole(role kubernetes.Role) Option {
+	return func(w *writer) {
+		w.role = role
+	}
+}
+
+func (w *writer) discoveryRole() kubernetes.Role {
+	if w.role == "" {
+		return kubernetes.RoleEndpoint
+	}
+
+	return w.role
+}
+
+// endpointLabel translates a __meta_kubernetes_endpoint_* label to the equivalent label for the discovery role
+func (w *writer) endpointLabel(name model.LabelName) model.LabelName {
+	if w.discoveryRole() != kubernetes.RoleEndpointSlice || !strings.HasPrefix(string(name), endpointLabelPrefix) {
+		return name
+	}
+
+	if translated, ok := endpointSliceLabels[name]; ok {
+		return translated
+	}
+
+	return name
+}
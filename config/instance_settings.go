@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Annotations on a ServiceMonitor that override the InstanceSettings for its instance configs
+const (
+	AnnotationWALTruncateFrequency = "grafana-agent-operator/wal-truncate-frequency"
+	AnnotationMinWALTime           = "grafana-agent-operator/min-wal-time"
+	AnnotationMaxWALTime           = "grafana-agent-operator/max-wal-time"
+	AnnotationRemoteFlushDeadline  = "grafana-agent-operator/remote-flush-deadline"
+	AnnotationWriteStaleOnShutdown = "grafana-agent-operator/write-stale-on-shutdown"
+)
+
+// InstanceSettingsAnnotations are the annotations that affect the generated instance configs
+var InstanceSettingsAnnotations = []string{
+	AnnotationWALTruncateFrequency,
+	AnnotationMinWALTime,
+	AnnotationMaxWALTime,
+	AnnotationRemoteFlushDeadline,
+	AnnotationWriteStaleOnShutdown,
+}
+
+// InstanceSettings are operator-level defaults for the WAL and remote write settings of every generated instance
+// config. Zero durations use the agent defaults. Each setting can be overridden per ServiceMonitor with the
+// corresponding annotation.
+type InstanceSettings struct {
+	// WALTruncateFrequency is how often the WAL is truncated. Scrape intervals may not be longer than this.
+	WALTruncateFrequency time.Duration
+	// MinWALTime is the minimum amount of time series are kept in the WAL for
+	MinWALTime time.Duration
+	// MaxWALTime is the maximum amount of time series are kept in the WAL for
+	MaxWALTime time.Duration
+	// RemoteFlushDeadline is how long to wait for remote write to flush when the instance is stopped
+	RemoteFlushDeadline time.Duration
+	// WriteStaleOnShutdown writes staleness markers for all series when the instance is stopped
+	WriteStaleOnShutdown bool
+}
+
+// WithInstanceSettings applies the specified settings to every generated instance config
+func WithInstanceSettings(s InstanceSettings) Option {
+	return func(w *writer) {
+		w.instanceSettings = s
+	}
+}
+
+// forServiceMonitor applies the overrides from the annotations on sm
+func (s InstanceSettings) forServiceMonitor(sm *v1.ServiceMonitor) (InstanceSettings, error) {
+	annotations := field.NewPath("metadata", "annotations")
+
+	for _, o := range []struct {
+		key    string
+		target *time.Duration
+	}{
+		{key: AnnotationWALTruncateFrequency, target: &s.WALTruncateFrequency},
+		{key: AnnotationMinWALTime, target: &s.MinWALTime},
+		{key: AnnotationMaxWALTime, target: &s.MaxWALTime},
+		{key: AnnotationRemoteFlushDeadline, target: &s.RemoteFlushDeadline},
+	} {
+		raw, ok := sm.Annotations[o.key]
+		if !ok {
+			continue
+		}
+
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return s, field.Invalid(annotations.Key(o.key), raw, err.Error())
+		} else if d <= 0 {
+			return s, field.Invalid(annotations.Key(o.key), raw, "must be greater than 0")
+		}
+
+		*o.target = d
+	}
+
+	if raw, ok := sm.Annotations[AnnotationWriteStaleOnShutdown]; ok {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return s, field.Invalid(annotations.Key(AnnotationWriteStaleOnShutdown), raw, "must be true or false")
+		}
+
+		s.WriteStaleOnShutdown = v
+	}
+
+	if min, max := s.effective().MinWALTime, s.effective().MaxWALTime; min > max {
+		return s, field.Invalid(
+			annotations.Key(AnnotationMinWALTime), min.String(),
+			fmt.Sprintf("must not be greater than the max WAL time of %s", max),
+		)
+	}
+
+	return s, nil
+}
+
+// effective returns the settings the agent will use, filling in its defaults for unset values
+func (s InstanceSettings) effective() InstanceSettings {
+	if s.WALTruncateFrequency == 0 {
+		s.WALTruncateFrequency = instance.DefaultConfig.WALTruncateFrequency
+	}
+
+	if s.MinWALTime == 0 {
+		s.MinWALTime = instance.DefaultConfig.MinWALTime
+	}
+
+	if s.MaxWALTime == 0 {
+		s.MaxWALTime = instance.DefaultConfig.MaxWALTime
+	}
+
+	if s.RemoteFlushDeadline == 0 {
+		s.RemoteFlushDeadline = instance.DefaultConfig.RemoteFlushDeadline
+	}
+
+	return s
+}
+
+func (s InstanceSettings) apply(cfg *instance.Config) {
+	cfg.WALTruncateFrequency = s.WALTruncateFrequency
+	cfg.MinWALTime = s.MinWALTime
+	cfg.MaxWALTime = s.MaxWALTime
+	cfg.RemoteFlushDeadline = s.RemoteFlushDeadline
+	cfg.WriteStaleOnShutdown = s.WriteStaleOnShutdown
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// LabelConflictPolicy decides what happens when a ServiceMonitor sets a label that is also a static label
+type LabelConflictPolicy string
+
+const (
+	// LabelConflictOverride replaces the value set by the ServiceMonitor with the static value
+	LabelConflictOverride LabelConflictPolicy = "override"
+	// LabelConflictKeep keeps the value set by the ServiceMonitor and only sets the static value on targets
+	// that do not have the label
+	LabelConflictKeep LabelConflictPolicy = "keep"
+	// LabelConflictReject fails validation of ServiceMonitors that set a static label in their targetLabels,
+	// podTargetLabels or relabelings
+	LabelConflictReject LabelConflictPolicy = "reject"
+)
+
+// LabelConflictPolicies are the supported values of LabelConflictPolicy
+var LabelConflictPolicies = []string{string(LabelConflictOverride), string(LabelConflictKeep), string(LabelConflictReject)}
+
+// StaticLabels are added to every target of the generated instance configs, for example to identify the cluster
+// the targets were discovered in
+type StaticLabels struct {
+	// Labels maps label names to the values every target gets
+	Labels map[string]string
+	// NamespaceLabels maps label names to the key of a label on the Namespace of the target to copy the value
+	// from. Namespaces are looked up with the lister passed to WithNamespaceLister.
+	NamespaceLabels map[string]string
+	// ConflictPolicy decides what happens when a ServiceMonitor sets one of these labels itself. Defaults to
+	// LabelConflictOverride.
+	ConflictPolicy LabelConflictPolicy
+}
+
+// WithStaticLabels adds the specified labels to every target as the final relabel rules of each scrape config
+func WithStaticLabels(s StaticLabels) Option {
+	return func(w *writer) {
+		w.staticLabels = s
+	}
+}
+
+// WithNamespaceLister looks up the Namespaces that StaticLabels.NamespaceLabels are copied from. Without it,
+// namespace labels are not added.
+func WithNamespaceLister(lister corelisters.NamespaceLister) Option {
+	return func(w *writer) {
+		w.namespaces = lister
+	}
+}
+
+// ParseLabelPairs parses name=value pairs into a map, trimming whitespace around names and values. Each item may
+// contain several comma-separated pairs.
+func ParseLabelPairs(items []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, item := range items {
+		for _, pair := range strings.Split(item, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return nil, fmt.Errorf("expected name=value, got '%s'", pair)
+			}
+
+			result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return result, nil
+}
+
+// ValidateStaticLabelName checks that name can be used as a static or namespace label
+func ValidateStaticLabelName(name string) error {
+	if !model.LabelName(name).IsValid() {
+		return fmt.Errorf("'%s' is not a valid label name", name)
+	} else if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+		return fmt.Errorf("'%s' uses the reserved %s prefix", name, model.ReservedLabelPrefix)
+	}
+
+	return nil
+}
+
+// SelectsNamespace returns true if targets of sm are discovered in the specified namespace
+func SelectsNamespace(sm *v1.ServiceMonitor, namespace string) bool {
+	namespaces := effectiveNamespaceSelector(sm)
+	if len(namespaces) == 0 {
+		return true
+	}
+
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staticLabelRelabelConfigs generates the relabel rules that add the static and namespace labels to the targets
+// of sm. They have to come after every other rule so the conflict policy applies to labels set by those rules.
+func (w *writer) staticLabelRelabelConfigs(sm *v1.ServiceMonitor, ep v1.Endpoint, path *field.Path) ([]*relabel.Config, error) {
+	if w.staticLabels.ConflictPolicy == LabelConflictReject {
+		if err := checkStaticLabelConflicts(sm, ep, path, w.staticLabels); err != nil {
+			return nil, err
+		}
+	}
+
+	keep := w.staticLabels.ConflictPolicy == LabelConflictKeep
+	return w.staticLabelRules(sm, "__meta_kubernetes_namespace", keep, func(string) bool { return true })
+}
+
+// staticLabelMetricRelabelConfigs generates the metric relabel rules that set the static and namespace labels again
+// after the metricRelabelings of ep, since those run after every relabel rule and would otherwise override the
+// static values. The namespace is taken from the namespace label the writer adds to every target.
+func (w *writer) staticLabelMetricRelabelConfigs(sm *v1.ServiceMonitor, ep v1.Endpoint) ([]*relabel.Config, error) {
+	if w.staticLabels.ConflictPolicy == LabelConflictKeep || w.staticLabels.ConflictPolicy == LabelConflictReject {
+		return nil, nil
+	}
+
+	targeted := map[string]bool{}
+	for _, rlc := range ep.MetricRelabelConfigs {
+		if rlc.TargetLabel != "" {
+			targeted[rlc.TargetLabel] = true
+		}
+	}
+
+	if len(targeted) == 0 {
+		return nil, nil
+	}
+
+	return w.staticLabelRules(sm, "namespace", false, func(name string) bool { return targeted[name] })
+}
+
+// staticLabelRules generates the rules that set the static and namespace labels accepted by include. Namespace
+// labels are matched against the namespace in namespaceLabel. With keep, labels that are already set are left as-is.
+func (w *writer) staticLabelRules(sm *v1.ServiceMonitor, namespaceLabel model.LabelName, keep bool, include func(name string) bool) ([]*relabel.Config, error) {
+	var results []*relabel.Config
+	for _, name := range sortedKeys(w.staticLabels.Labels) {
+		if !include(name) {
+			continue
+		}
+
+		rlc := &relabel.Config{
+			TargetLabel: name,
+			Replacement: escapeReplacement(w.staticLabels.Labels[name]),
+		}
+
+		if keep {
+			rlc.SourceLabels = []model.LabelName{model.LabelName(name)}
+			rlc.Regex = relabel.MustNewRegexp("^$")
+		}
+
+		results = append(results, rlc)
+	}
+
+	if w.namespaces == nil || len(w.staticLabels.NamespaceLabels) == 0 {
+		return results, nil
+	}
+
+	namespaces, err := w.lookupNamespaceLabels(sm)
+	if err != nil {
+		return nil, err
+	}
+
+	nsNames := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		nsNames = append(nsNames, ns)
+	}
+	sort.Strings(nsNames)
+
+	for _, name := range sortedKeys(w.staticLabels.NamespaceLabels) {
+		if !include(name) {
+			continue
+		}
+
+		key := w.staticLabels.NamespaceLabels[name]
+
+		for _, ns := range nsNames {
+			value, ok := namespaces[ns][key]
+			if !ok {
+				continue
+			}
+
+			// Namespace names cannot contain the separator, so the regex only matches targets in ns
+			rlc := &relabel.Config{
+				SourceLabels: []model.LabelName{namespaceLabel},
+				Regex:        relabel.MustNewRegexp(regexp.QuoteMeta(ns)),
+				TargetLabel:  name,
+				Replacement:  escapeReplacement(value),
+			}
+
+			if keep {
+				rlc.SourceLabels = append(rlc.SourceLabels, model.LabelName(name))
+				rlc.Separator = ";"
+				rlc.Regex = relabel.MustNewRegexp(regexp.QuoteMeta(ns) + ";")
+			}
+
+			results = append(results, rlc)
+		}
+	}
+
+	return results, nil
+}
+
+// lookupNamespaceLabels returns the labels of each existing namespace targets of sm are discovered in
+func (w *writer) lookupNamespaceLabels(sm *v1.ServiceMonitor) (map[string]map[string]string, error) {
+	result := map[string]map[string]string{}
+
+	names := effectiveNamespaceSelector(sm)
+	if len(names) == 0 {
+		namespaces, err := w.namespaces.List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list namespaces: %w", err)
+		}
+
+		for _, ns := range namespaces {
+			result[ns.Name] = ns.Labels
+		}
+
+		return result, nil
+	}
+
+	for _, name := range names {
+		ns, err := w.namespaces.Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get namespace %s: %w", name, err)
+		}
+
+		result[ns.Name] = ns.Labels
+	}
+
+	return result, nil
+}
+
+// checkStaticLabelConflicts returns an error for the first label in sm or ep that is also a static label
+func checkStaticLabelConflicts(sm *v1.ServiceMonitor, ep v1.Endpoint, path *field.Path, s StaticLabels) error {
+	conflicts := func(name string) bool {
+		_, static := s.Labels[name]
+		_, namespace := s.NamespaceLabels[name]
+		return static || namespace
+	}
+
+	detail := func(name string) string {
+		return fmt.Sprintf("sets the label %s, which is set by the operator", name)
+	}
+
+	spec := field.NewPath("spec")
+	for i, l := range sm.Spec.TargetLabels {
+		if conflicts(safeLabelName(l)) {
+			return field.Invalid(spec.Child("targetLabels").Index(i), l, detail(safeLabelName(l)))
+		}
+	}
+
+	for i, l := range sm.Spec.PodTargetLabels {
+		if conflicts(safeLabelName(l)) {
+			return field.Invalid(spec.Child("podTargetLabels").Index(i), l, detail(safeLabelName(l)))
+		}
+	}
+
+	for _, rlcs := range []struct {
+		name  string
+		items []*v1.RelabelConfig
+	}{
+		{name: "relabelings", items: ep.RelabelConfigs},
+		{name: "metricRelabelings", items: ep.MetricRelabelConfigs},
+	} {
+		for i, rlc := range rlcs.items {
+			if rlc.TargetLabel != "" && conflicts(rlc.TargetLabel) {
+				return field.Invalid(path.Child(rlcs.name).Index(i).Child("targetLabel"), rlc.TargetLabel, detail(rlc.TargetLabel))
+			}
+		}
+	}
+
+	return nil
+}
+
+// escapeReplacement escapes value so it is used as-is instead of being expanded as a regex replacement
+func escapeReplacement(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+)
+
+// Limits are operator-level defaults and maxima applied to every generated ScrapeConfig. Zero values disable
+// the corresponding default or limit.
+type Limits struct {
+	// DefaultInterval is used for endpoints that do not specify an interval. It must not be below MinInterval.
+	DefaultInterval model.Duration
+	// DefaultTimeout is used for endpoints that do not specify a scrape timeout
+	DefaultTimeout model.Duration
+
+	// MinInterval is the shortest scrape interval an endpoint may request
+	MinInterval model.Duration
+	// MaxSampleLimit is the largest sampleLimit a ServiceMonitor may request. ServiceMonitors without a
+	// sampleLimit get this limit.
+	MaxSampleLimit uint
+	// MaxTargetLimit is the largest targetLimit a ServiceMonitor may request. ServiceMonitors without a
+	// targetLimit get this limit.
+	MaxTargetLimit uint
+}
+
+// WithLimits applies the specified defaults and limits to every generated ScrapeConfig
+func WithLimits(l Limits) Option {
+	return func(w *writer) {
+		w.limits = l
+	}
+}
+
+// apply enforces the limits on the provided ScrapeConfig, returning a warning for each value that was clamped
+func (l Limits) apply(sc *config.ScrapeConfig) []string {
+	var warnings []string
+
+	// Only intervals requested by the endpoint are clamped, the default is validated against the minimum up front
+	if l.MinInterval != 0 && sc.ScrapeInterval != 0 && sc.ScrapeInterval < l.MinInterval {
+		warnings = append(warnings, fmt.Sprintf(
+			"%s: interval %s is below the minimum of %s, using %s instead",
+			sc.JobName, sc.ScrapeInterval, l.MinInterval, l.MinInterval,
+		))
+		sc.ScrapeInterval = l.MinInterval
+	}
+
+	if sc.ScrapeInterval == 0 {
+		sc.ScrapeInterval = l.DefaultInterval
+	}
+
+	// Without any interval the agent scrapes at its global default, which may itself be below the minimum
+	if l.MinInterval != 0 && sc.ScrapeInterval == 0 && config.DefaultGlobalConfig.ScrapeInterval < l.MinInterval {
+		sc.ScrapeInterval = l.MinInterval
+	}
+
+	// Only use the default timeout if it fits within the scrape interval, otherwise the agent will reject it
+	if sc.ScrapeTimeout == 0 && (sc.ScrapeInterval == 0 || l.DefaultTimeout <= sc.ScrapeInterval) {
+		sc.ScrapeTimeout = l.DefaultTimeout
+	}
+
+	if l.MaxSampleLimit != 0 {
+		if sc.SampleLimit > l.MaxSampleLimit {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s: sampleLimit %d exceeds the maximum of %d, using %d instead",
+				sc.JobName, sc.SampleLimit, l.MaxSampleLimit, l.MaxSampleLimit,
+			))
+			sc.SampleLimit = l.MaxSampleLimit
+		} else if sc.SampleLimit == 0 {
+			sc.SampleLimit = l.MaxSampleLimit
+		}
+	}
+
+	if l.MaxTargetLimit != 0 {
+		if sc.TargetLimit > l.MaxTargetLimit {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s: targetLimit %d exceeds the maximum of %d, using %d instead",
+				sc.JobName, sc.TargetLimit, l.MaxTargetLimit, l.MaxTargetLimit,
+			))
+			sc.TargetLimit = l.MaxTargetLimit
+		} else if sc.TargetLimit == 0 {
+			sc.TargetLimit = l.MaxTargetLimit
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// InstanceName is the name of the instance config generated for the specified endpoint of a ServiceMonitor
+func InstanceName(sm *v1.ServiceMonitor, endpointNumber int) string {
+	return fmt.Sprintf("%s/%s/%d", sm.Namespace, sm.Name, endpointNumber)
+}
+
+// InstanceNames are the names of the instance configs generated for each endpoint of a ServiceMonitor. Unlike
+// generating the configs, this cannot fail, so it is used to find the configs to delete.
+func InstanceNames(sm *v1.ServiceMonitor) []string {
+	names := make([]string, len(sm.Spec.Endpoints))
+	for i := range sm.Spec.Endpoints {
+		names[i] = InstanceName(sm, i)
+	}
+
+	return names
+}
+
+// ParseInstanceName extracts the ServiceMonitor and endpoint from an instance config name. ok is false if the
+// name was not generated by a writer.
+func ParseInstanceName(name string) (namespace, serviceMonitor string, endpointNumber int, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", 0, false
+	}
+
+	endpointNumber, err := strconv.Atoi(parts[2])
+	if err != nil || endpointNumber < 0 {
+		return "", "", 0, false
+	}
+
+	return parts[0], parts[1], endpointNumber, true
+}
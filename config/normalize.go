@@ -0,0 +1,47 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/prometheus/prometheus/config"
+)
+
+// Normalize renders the config the way the agent stores it: with instance and scrape config defaults applied
+// and secrets scrubbed. Configs generated by a writer and configs fetched from the agent can be compared by
+// their normalized form.
+func Normalize(cfg *instance.Config) (string, error) {
+	result, err := applyAgentDefaults(cfg)
+	if err != nil {
+		return "", fmt.Errorf("normalize: %w", err)
+	}
+
+	raw, err := instance.MarshalConfig(result, true)
+	if err != nil {
+		return "", fmt.Errorf("normalize: marshal: %w", err)
+	}
+
+	return string(raw), nil
+}
+
+// applyAgentDefaults loads a copy of cfg the way the agent does when it is stored, applying the same defaults and
+// validation
+func applyAgentDefaults(cfg *instance.Config) (*instance.Config, error) {
+	raw, err := instance.MarshalConfig(cfg, false)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+
+	result, err := instance.UnmarshalConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	global := config.DefaultGlobalConfig
+	if err := result.ApplyDefaults(&global); err != nil {
+		return nil, fmt.Errorf("apply defaults: %w", err)
+	}
+
+	return result, nil
+}
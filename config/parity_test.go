@@ -0,0 +1,174 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/k8sutil"
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/kubernetes"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// knownDifference adjusts the scrape configs generated by prometheus-operator and the writer for one way in which
+// they are known to differ, so the parity tests only fail on differences that have not been accounted for
+type knownDifference struct {
+	description string
+	apply       func(ep v1.Endpoint, upstream, ours *config.ScrapeConfig)
+}
+
+var knownDifferences = []knownDifference{
+	{
+		description: "prometheus-operator shards targets across Prometheus replicas, the agent does not",
+		apply: func(_ v1.Endpoint, upstream, _ *config.ScrapeConfig) {
+			upstream.RelabelConfigs = filterRelabelConfigs(upstream.RelabelConfigs, func(rlc *relabel.Config) bool {
+				return rlc.TargetLabel != "__tmp_hash" && !hasSourceLabel(rlc, "__tmp_hash")
+			})
+		},
+	},
+	{
+		description: "label selectors are pushed down to service discovery instead of being enforced with relabel rules",
+		apply: func(_ v1.Endpoint, upstream, ours *config.ScrapeConfig) {
+			upstream.RelabelConfigs = filterRelabelConfigs(upstream.RelabelConfigs, isNotSelectorRule)
+			ours.RelabelConfigs = filterRelabelConfigs(ours.RelabelConfigs, isNotSelectorRule)
+
+			for _, sd := range ours.ServiceDiscoveryConfigs {
+				sd.(*kubernetes.SDConfig).Selectors = nil
+			}
+		},
+	},
+	{
+		description: "the service name is stored in the service_name label instead of service",
+		apply: func(_ v1.Endpoint, _, ours *config.ScrapeConfig) {
+			for _, rlc := range ours.RelabelConfigs {
+				if rlc.TargetLabel == "service_name" {
+					rlc.TargetLabel = "service"
+				}
+			}
+		},
+	},
+	{
+		description: "honor_timestamps defaults to false instead of the Prometheus default of true",
+		apply: func(ep v1.Endpoint, upstream, _ *config.ScrapeConfig) {
+			if ep.HonorTimestamps == nil {
+				upstream.HonorTimestamps = false
+			}
+		},
+	},
+}
+
+// TestUpstreamParity compares the scrape configs generated for the ServiceMonitors in testdata/parity against the
+// ones prometheus-operator generates for them. Run hack/update-parity-goldens.sh after adding a fixture or updating
+// prometheus-operator to regenerate the golden files.
+func TestUpstreamParity(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	sut := NewWriter(&instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}})
+
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "parity", "*.yaml"))
+	require.NoError(t, err)
+
+	for _, fixture := range fixtures {
+		if strings.HasSuffix(fixture, ".golden.yaml") {
+			continue
+		}
+
+		t.Run(strings.TrimSuffix(filepath.Base(fixture), ".yaml"), func(t *testing.T) {
+			sm := readParityFixture(t, fixture)
+
+			raw, err := ioutil.ReadFile(strings.TrimSuffix(fixture, ".yaml") + ".golden.yaml")
+			require.NoError(t, err, "missing golden file, run hack/update-parity-goldens.sh")
+
+			var upstream []*config.ScrapeConfig
+			require.NoError(t, yaml.UnmarshalStrict(raw, &upstream))
+
+			cfgs, warnings, err := sut.ScrapeConfigsForServiceMonitor(sm)
+			require.NoError(t, err)
+			require.Empty(t, warnings)
+			require.Len(t, cfgs, len(upstream), "the number of generated scrape configs differs")
+
+			for i, cfg := range cfgs {
+				require.Len(t, cfg.ScrapeConfigs, 1)
+				ours := reloadScrapeConfig(t, cfg.ScrapeConfigs[0])
+
+				for _, d := range knownDifferences {
+					d.apply(sm.Spec.Endpoints[i], upstream[i], ours)
+				}
+
+				require.Equal(t, marshalScrapeConfig(t, upstream[i]), marshalScrapeConfig(t, ours), "endpoint %d", i)
+			}
+		})
+	}
+}
+
+func readParityFixture(t *testing.T, path string) *v1.ServiceMonitor {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+
+	sms, err := k8sutil.DecodeServiceMonitors(f)
+	require.NoError(t, err)
+	require.Len(t, sms, 1)
+
+	return sms[0]
+}
+
+// reloadScrapeConfig round-trips sc through YAML so it has the same defaults applied as a scrape config loaded by
+// Prometheus
+func reloadScrapeConfig(t *testing.T, sc *config.ScrapeConfig) *config.ScrapeConfig {
+	raw, err := yaml.Marshal(sc)
+	require.NoError(t, err)
+
+	result := &config.ScrapeConfig{}
+	require.NoError(t, yaml.UnmarshalStrict(raw, result))
+
+	return result
+}
+
+func marshalScrapeConfig(t *testing.T, sc *config.ScrapeConfig) string {
+	raw, err := yaml.Marshal(sc)
+	require.NoError(t, err)
+
+	return string(raw)
+}
+
+func filterRelabelConfigs(rlcs []*relabel.Config, keep func(rlc *relabel.Config) bool) []*relabel.Config {
+	var results []*relabel.Config
+	for _, rlc := range rlcs {
+		if keep(rlc) {
+			results = append(results, rlc)
+		}
+	}
+
+	return results
+}
+
+func hasSourceLabel(rlc *relabel.Config, name string) bool {
+	for _, l := range rlc.SourceLabels {
+		if string(l) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isNotSelectorRule(rlc *relabel.Config) bool {
+	if rlc.Action != relabel.Keep && rlc.Action != relabel.Drop || len(rlc.SourceLabels) != 1 {
+		return true
+	}
+
+	l := string(rlc.SourceLabels[0])
+	return !strings.HasPrefix(l, "__meta_kubernetes_service_label_") &&
+		!strings.HasPrefix(l, "__meta_kubernetes_service_labelpresent_")
+}
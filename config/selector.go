@@ -0,0 +1,125 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var selectorOperators = map[metav1.LabelSelectorOperator]selection.Operator{
+	metav1.LabelSelectorOpIn:           selection.In,
+	metav1.LabelSelectorOpNotIn:        selection.NotIn,
+	metav1.LabelSelectorOpExists:       selection.Exists,
+	metav1.LabelSelectorOpDoesNotExist: selection.DoesNotExist,
+}
+
+// WithSelectorPushdown decides whether ServiceMonitor selectors are passed to Kubernetes service discovery, which is
+// the default. The API server then filters Endpoints by their own labels, so Endpoints whose labels differ from their
+// Service's, like ones maintained by hand for a Service without a selector, are no longer discovered. Without
+// pushdown, every Endpoints object in the namespaces is discovered and the selector is enforced on the labels of the
+// Service with relabel rules, like prometheus-operator does.
+func WithSelectorPushdown(enabled bool) Option {
+	return func(w *writer) {
+		w.selectorPushdown = enabled
+	}
+}
+
+// serverSideSelector returns the requirements of sel the kubernetes API server can evaluate for service discovery.
+// Requirements that cannot be expressed server-side, such as keys that are not valid label names, are left out and
+// have to be enforced by selectorRelabelConfigs instead.
+func serverSideSelector(sel metav1.LabelSelector) string {
+	selector := labels.NewSelector()
+
+	for _, k := range sortedKeys(sel.MatchLabels) {
+		if req, ok := matchLabelRequirement(k, sel.MatchLabels[k]); ok {
+			selector = selector.Add(*req)
+		}
+	}
+
+	for _, exp := range sel.MatchExpressions {
+		if req, ok := matchExpressionRequirement(exp); ok {
+			selector = selector.Add(*req)
+		}
+	}
+
+	return selector.String()
+}
+
+// selectorRelabelConfigs enforces the requirements of sel on the labels of the service with keep and drop relabel
+// rules. If pushdown is set, the requirements serverSideSelector passes to service discovery are skipped.
+func selectorRelabelConfigs(path *field.Path, sel metav1.LabelSelector, pushdown bool) ([]*relabel.Config, field.ErrorList) {
+	var results []*relabel.Config
+	var errs field.ErrorList
+
+	for _, k := range sortedKeys(sel.MatchLabels) {
+		if _, ok := matchLabelRequirement(k, sel.MatchLabels[k]); ok && pushdown {
+			continue
+		}
+
+		regex, err := newRegexp(path.Child("matchLabels").Key(k), sel.MatchLabels[k])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		results = append(results, &relabel.Config{
+			Action:       relabel.Keep,
+			SourceLabels: []model.LabelName{model.LabelName("__meta_kubernetes_service_label_" + safeLabelName(k))},
+			Regex:        regex,
+		})
+	}
+
+	for i, exp := range sel.MatchExpressions {
+		if _, ok := matchExpressionRequirement(exp); ok && pushdown {
+			continue
+		}
+
+		action, source, expr := relabel.Keep, "__meta_kubernetes_service_label_", strings.Join(exp.Values, "|")
+		switch exp.Operator {
+		case metav1.LabelSelectorOpIn:
+		case metav1.LabelSelectorOpNotIn:
+			action = relabel.Drop
+		case metav1.LabelSelectorOpExists:
+			source, expr = "__meta_kubernetes_service_labelpresent_", "true"
+		case metav1.LabelSelectorOpDoesNotExist:
+			action, source, expr = relabel.Drop, "__meta_kubernetes_service_labelpresent_", "true"
+		default:
+			// Unknown operators are ignored, just like prometheus-operator does
+			continue
+		}
+
+		regex, err := newRegexp(path.Child("matchExpressions").Index(i).Child("values"), expr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		results = append(results, &relabel.Config{
+			Action:       action,
+			SourceLabels: []model.LabelName{model.LabelName(source + safeLabelName(exp.Key))},
+			Regex:        regex,
+		})
+	}
+
+	return results, errs
+}
+
+func matchLabelRequirement(key, value string) (*labels.Requirement, bool) {
+	req, err := labels.NewRequirement(key, selection.Equals, []string{value})
+	return req, err == nil
+}
+
+func matchExpressionRequirement(exp metav1.LabelSelectorRequirement) (*labels.Requirement, bool) {
+	op, ok := selectorOperators[exp.Operator]
+	if !ok {
+		return nil, false
+	}
+
+	req, err := labels.NewRequirement(exp.Key, op, exp.Values)
+	return req, err == nil
+}
@@ -1,10 +1,7 @@
 package config
 
 import (
-	"fmt"
 	"net/url"
-	"sort"
-	"strings"
 
 	"github.com/grafana/agent/pkg/prom/instance"
 	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
@@ -13,20 +10,34 @@ import (
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/discovery"
 	"github.com/prometheus/prometheus/pkg/relabel"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
-func (w *writer) ScrapeConfigsForServiceMonitor(sm *v1.ServiceMonitor) []*instance.Config {
+func (w *writer) ScrapeConfigsForServiceMonitor(sm *v1.ServiceMonitor) ([]*instance.Config, []string, error) {
+	settings, err := w.instanceSettings.forServiceMonitor(sm)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	results := make([]*instance.Config, len(sm.Spec.Endpoints))
+	var warnings []string
 
 	for i, ep := range sm.Spec.Endpoints {
-		results[i] = w.makeInstanceForServiceMonitorEndpoint(sm, ep, i)
+		var epWarnings []string
+		results[i], epWarnings, err = w.makeInstanceForServiceMonitorEndpoint(sm, ep, i)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		settings.apply(results[i])
+		results[i].HostFilter = w.hostFilter
+		warnings = append(warnings, epWarnings...)
 	}
 
-	return results
+	return results, warnings, nil
 }
 
-func (w *writer) makeInstanceForServiceMonitorEndpoint(sm *v1.ServiceMonitor, ep v1.Endpoint, endpointNumber int) *instance.Config {
+func (w *writer) makeInstanceForServiceMonitorEndpoint(sm *v1.ServiceMonitor, ep v1.Endpoint, endpointNumber int) (*instance.Config, []string, error) {
 	// TODO: Can we contribute to the operator to write this for us? This is mostly copied from the operator
 	//       See https://github.com/prometheus-operator/prometheus-operator/blob/d97ba662bc94d64e254e116f3cbf573068ac2d87/pkg/prometheus/promcfg.go#L851
 	honorTimestamps := false
@@ -35,16 +46,20 @@ func (w *writer) makeInstanceForServiceMonitorEndpoint(sm *v1.ServiceMonitor, ep
 		honorTimestamps = *ep.HonorTimestamps
 	}
 
-	name := fmt.Sprintf("%s/%s/%d", sm.Namespace, sm.Name, endpointNumber)
+	name := InstanceName(sm, endpointNumber)
+	path := field.NewPath("spec", "endpoints").Index(endpointNumber)
 	namespaces := effectiveNamespaceSelector(sm)
+	labelSelector := ""
+	if w.selectorPushdown {
+		labelSelector = serverSideSelector(sm.Spec.Selector)
+	}
 
-	// TODO: What should we do about errors when building up the config?
 	sc := &config.ScrapeConfig{
 		JobName: name,
 		// TODO: Override at the operator level?
 		HonorLabels:             ep.HonorLabels,
 		HonorTimestamps:         honorTimestamps,
-		ServiceDiscoveryConfigs: discovery.Configs{sdConfig(namespaces)},
+		ServiceDiscoveryConfigs: discovery.Configs{w.sdConfig(namespaces, labelSelector)},
 		SampleLimit:             uint(sm.Spec.SampleLimit),
 		TargetLimit:             uint(sm.Spec.TargetLimit),
 	}
@@ -57,13 +72,18 @@ func (w *writer) makeInstanceForServiceMonitorEndpoint(sm *v1.ServiceMonitor, ep
 		sc.ScrapeTimeout, _ = model.ParseDuration(ep.ScrapeTimeout)
 	}
 
+	warnings := w.limits.apply(sc)
+
 	if ep.Path != "" {
 		sc.MetricsPath = ep.Path
 	}
 
 	if ep.ProxyURL != nil {
-		u, _ := url.Parse(*ep.ProxyURL)
-		// TODO: Handle error
+		u, err := url.Parse(*ep.ProxyURL)
+		if err != nil {
+			return nil, nil, field.Invalid(path.Child("proxyUrl"), *ep.ProxyURL, err.Error())
+		}
+
 		sc.HTTPClientConfig.ProxyURL = commonconfig.URL{URL: u}
 	}
 
@@ -100,81 +120,35 @@ func (w *writer) makeInstanceForServiceMonitorEndpoint(sm *v1.ServiceMonitor, ep
 	//	// TODO: Bearer token secrets
 	//}
 
-	var labelKeys []string
-	for k := range sm.Spec.Selector.MatchLabels {
-		labelKeys = append(labelKeys, k)
-	}
-	sort.Strings(labelKeys)
+	// TODO: OAuth2 and Authorization credentials. Neither the ServiceMonitor API (prometheus-operator v0.46) nor
+	//  HTTPClientConfig (prometheus/common v0.15, which the agent validates configs against) have these fields yet,
+	//  so this needs a prometheus-operator, prometheus/common and agent upgrade first.
 
-	for _, k := range labelKeys {
-		sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-			Action:       relabel.Keep,
-			SourceLabels: []model.LabelName{model.LabelName("__meta_kubernetes_service_label_" + safeLabelName(k))},
-			Regex:        relabel.MustNewRegexp(sm.Spec.Selector.MatchLabels[k]),
-		})
+	// Requirements that could not be pushed down to service discovery are enforced with relabel rules instead
+	selectorRelabelings, errs := selectorRelabelConfigs(field.NewPath("spec", "selector"), sm.Spec.Selector, w.selectorPushdown)
+	if len(errs) > 0 {
+		return nil, nil, errs.ToAggregate()
 	}
+	sc.RelabelConfigs = append(sc.RelabelConfigs, selectorRelabelings...)
 
-	for _, exp := range sm.Spec.Selector.MatchExpressions {
-		switch exp.Operator {
-		case metav1.LabelSelectorOpIn:
-			sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-				Action:       relabel.Keep,
-				SourceLabels: []model.LabelName{model.LabelName("__meta_kubernetes_service_label_" + safeLabelName(exp.Key))},
-				Regex:        relabel.MustNewRegexp(strings.Join(exp.Values, "|")),
-			})
-		case metav1.LabelSelectorOpNotIn:
-			sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-				Action:       relabel.Drop,
-				SourceLabels: []model.LabelName{model.LabelName("__meta_kubernetes_service_label_" + safeLabelName(exp.Key))},
-				Regex:        relabel.MustNewRegexp(strings.Join(exp.Values, "|")),
-			})
-		case metav1.LabelSelectorOpExists:
-			sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-				Action:       relabel.Keep,
-				SourceLabels: []model.LabelName{model.LabelName("__meta_kubernetes_service_labelpresent_" + safeLabelName(exp.Key))},
-				Regex:        relabel.MustNewRegexp("true"),
-			})
-		case metav1.LabelSelectorOpDoesNotExist:
-			sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-				Action:       relabel.Drop,
-				SourceLabels: []model.LabelName{model.LabelName("__meta_kubernetes_service_labelpresent_" + safeLabelName(exp.Key))},
-				Regex:        relabel.MustNewRegexp("true"),
-			})
-		}
+	portRelabeling, portErr := w.portRelabelConfig(path, ep)
+	if portErr != nil {
+		return nil, nil, portErr
 	}
-
-	if ep.Port != "" {
-		sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-			Action:       relabel.Keep,
-			SourceLabels: []model.LabelName{"__meta_kubernetes_endpoint_port_name"},
-			Regex:        relabel.MustNewRegexp(ep.Port),
-		})
-	} else if ep.TargetPort != nil {
-		if ep.TargetPort.StrVal != "" {
-			sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-				Action:       relabel.Keep,
-				SourceLabels: []model.LabelName{"__meta_kubernetes_endpoint_port_name"},
-				Regex:        relabel.MustNewRegexp(ep.TargetPort.String()),
-			})
-		} else if ep.TargetPort.IntVal != 0 {
-			sc.RelabelConfigs = append(sc.RelabelConfigs, &relabel.Config{
-				Action:       relabel.Keep,
-				SourceLabels: []model.LabelName{"__meta_kubernetes_endpoint_port_number"},
-				Regex:        relabel.MustNewRegexp(ep.TargetPort.String()),
-			})
-		}
+	if portRelabeling != nil {
+		sc.RelabelConfigs = append(sc.RelabelConfigs, portRelabeling)
 	}
 
 	sc.RelabelConfigs = append(sc.RelabelConfigs, []*relabel.Config{
 		{
-			SourceLabels: []model.LabelName{"__meta_kubernetes_endpoint_address_target_kind", "__meta_kubernetes_endpoint_address_target_name"},
+			SourceLabels: []model.LabelName{w.endpointLabel("__meta_kubernetes_endpoint_address_target_kind"), w.endpointLabel("__meta_kubernetes_endpoint_address_target_name")},
 			Separator:    ";",
 			Regex:        relabel.MustNewRegexp("Node;(.*)"),
 			Replacement:  "${1}",
 			TargetLabel:  "node",
 		},
 		{
-			SourceLabels: []model.LabelName{"__meta_kubernetes_endpoint_address_target_kind", "__meta_kubernetes_endpoint_address_target_name"},
+			SourceLabels: []model.LabelName{w.endpointLabel("__meta_kubernetes_endpoint_address_target_kind"), w.endpointLabel("__meta_kubernetes_endpoint_address_target_name")},
 			Separator:    ";",
 			Regex:        relabel.MustNewRegexp("Pod;(.*)"),
 			Replacement:  "${1}",
@@ -247,15 +221,65 @@ func (w *writer) makeInstanceForServiceMonitorEndpoint(sm *v1.ServiceMonitor, ep
 		})
 	}
 
-	sc.RelabelConfigs = append(sc.RelabelConfigs, makeRelabelConfigs(ep.RelabelConfigs)...)
+	relabelings, errs := makeRelabelConfigs(path.Child("relabelings"), ep.RelabelConfigs)
+	if len(errs) > 0 {
+		return nil, nil, errs.ToAggregate()
+	}
+	sc.RelabelConfigs = append(sc.RelabelConfigs, relabelings...)
 
 	// TODO: Enforce Namespace Label from the operator?
 
-	sc.RelabelConfigs = append(sc.RelabelConfigs, makeRelabelConfigs(ep.MetricRelabelConfigs)...)
+	metricRelabelings, errs := makeRelabelConfigs(path.Child("metricRelabelings"), ep.MetricRelabelConfigs)
+	if len(errs) > 0 {
+		return nil, nil, errs.ToAggregate()
+	}
+	sc.MetricRelabelConfigs = append(sc.MetricRelabelConfigs, metricRelabelings...)
+
+	staticLabels, err := w.staticLabelRelabelConfigs(sm, ep, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc.RelabelConfigs = append(sc.RelabelConfigs, staticLabels...)
+
+	staticMetricLabels, err := w.staticLabelMetricRelabelConfigs(sm, ep)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc.MetricRelabelConfigs = append(sc.MetricRelabelConfigs, staticMetricLabels...)
 
 	return &instance.Config{
 		Name:          name,
 		ScrapeConfigs: []*config.ScrapeConfig{sc},
 		RemoteWrite:   []*instance.RemoteWriteConfig{w.rwc},
+	}, warnings, nil
+}
+
+// portRelabelConfig keeps the targets of the port or targetPort selected by ep. It returns nil if ep selects
+// neither.
+func (w *writer) portRelabelConfig(path *field.Path, ep v1.Endpoint) (*relabel.Config, *field.Error) {
+	var source model.LabelName
+	var expr string
+	var p *field.Path
+
+	switch {
+	case ep.Port != "":
+		source, expr, p = w.endpointLabel("__meta_kubernetes_endpoint_port_name"), ep.Port, path.Child("port")
+	case ep.TargetPort != nil && ep.TargetPort.StrVal != "":
+		source, expr, p = "__meta_kubernetes_pod_container_port_name", ep.TargetPort.String(), path.Child("targetPort")
+	case ep.TargetPort != nil && ep.TargetPort.IntVal != 0:
+		source, expr, p = "__meta_kubernetes_pod_container_port_number", ep.TargetPort.String(), path.Child("targetPort")
+	default:
+		return nil, nil
 	}
+
+	regex, err := newRegexp(p, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &relabel.Config{
+		Action:       relabel.Keep,
+		SourceLabels: []model.LabelName{source},
+		Regex:        regex,
+	}, nil
 }
@@ -1,24 +1,32 @@
 package config
 
 import (
+	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/agent/pkg/prom/instance"
 	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/discovery/kubernetes"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 func genConfig(sut *writer, ep v1.Endpoint) *instance.Config {
-	return sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+	cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "dummy",
 			Namespace: "myapp",
@@ -27,6 +35,8 @@ func genConfig(sut *writer, ep v1.Endpoint) *instance.Config {
 			Endpoints: []v1.Endpoint{ep},
 		},
 	}, ep, 0)
+
+	return cfg
 }
 
 func getSDConfig(i *instance.Config) *kubernetes.SDConfig {
@@ -35,10 +45,10 @@ func getSDConfig(i *instance.Config) *kubernetes.SDConfig {
 
 func TestMakeInstanceForServiceMonitor(t *testing.T) {
 	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
-	sut := &writer{rwc: &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}}
+	sut := &writer{rwc: &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}, selectorPushdown: true}
 
 	t.Run("Instance Per Endpoint", func(t *testing.T) {
-		configs := sut.ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
+		configs, _, _ := sut.ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "dummy",
 				Namespace: "myapp",
@@ -102,7 +112,7 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 			})
 
 			t.Run("Namespace Selector Any", func(t *testing.T) {
-				cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+				cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "dummy",
 						Namespace: "myapp",
@@ -117,7 +127,7 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 			})
 
 			t.Run("Same Namespace", func(t *testing.T) {
-				cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+				cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "dummy",
 						Namespace: "myapp",
@@ -133,7 +143,7 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 			})
 
 			t.Run("Match Names", func(t *testing.T) {
-				cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+				cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "dummy",
 						Namespace: "myapp",
@@ -256,7 +266,31 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 		})
 
 		t.Run("Match Labels", func(t *testing.T) {
-			cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "dummy",
+					Namespace: "myapp",
+				},
+				Spec: v1.ServiceMonitorSpec{
+					Endpoints: []v1.Endpoint{},
+					Selector: metav1.LabelSelector{MatchLabels: map[string]string{
+						"z":                  "1",
+						"b":                  "2",
+						"example.com/domain": "3",
+					}},
+				},
+			}, v1.Endpoint{}, 0)
+
+			assert.Equal(t, []kubernetes.SelectorConfig{
+				{Role: kubernetes.RoleEndpoint, Label: "b=2,example.com/domain=3,z=1"},
+				{Role: kubernetes.RoleService, Label: "b=2,example.com/domain=3,z=1"},
+			}, getSDConfig(cfg).Selectors)
+
+			assertNoSelectorRLCs(t, cfg.ScrapeConfigs[0])
+		})
+
+		t.Run("Match Labels Fallback", func(t *testing.T) {
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "dummy",
 					Namespace: "myapp",
@@ -265,25 +299,28 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 					Endpoints: []v1.Endpoint{},
 					Selector: metav1.LabelSelector{MatchLabels: map[string]string{
 						"z":     "1",
-						"b":     "2",
+						"b":     "2|3",
 						"a/b/c": "3",
 					}},
 				},
 			}, v1.Endpoint{}, 0)
 
+			assert.Equal(t, []kubernetes.SelectorConfig{
+				{Role: kubernetes.RoleEndpoint, Label: "z=1"},
+				{Role: kubernetes.RoleService, Label: "z=1"},
+			}, getSDConfig(cfg).Selectors)
+
 			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_a_b_c", "^(?:3)$")
-			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_b", "^(?:2)$")
-			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_z", "^(?:1)$")
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_b", "^(?:2|3)$")
 
 			t.Run("Sorted", func(t *testing.T) {
 				assert.Equal(t, "__meta_kubernetes_service_label_a_b_c", string(cfg.ScrapeConfigs[0].RelabelConfigs[0].SourceLabels[0]))
 				assert.Equal(t, "__meta_kubernetes_service_label_b", string(cfg.ScrapeConfigs[0].RelabelConfigs[1].SourceLabels[0]))
-				assert.Equal(t, "__meta_kubernetes_service_label_z", string(cfg.ScrapeConfigs[0].RelabelConfigs[2].SourceLabels[0]))
 			})
 		})
 
 		t.Run("Match Expressions", func(t *testing.T) {
-			cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "dummy",
 					Namespace: "myapp",
@@ -299,12 +336,68 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 				},
 			}, v1.Endpoint{}, 0)
 
-			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_in", "^(?:a|b)$")
-			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Drop, "__meta_kubernetes_service_label_notin", "^(?:c|d)$")
-			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_labelpresent_exists", "^(?:true)$")
+			expected := "exists,in in (a,b),!notexists,notin notin (c,d)"
+			assert.Equal(t, []kubernetes.SelectorConfig{
+				{Role: kubernetes.RoleEndpoint, Label: expected},
+				{Role: kubernetes.RoleService, Label: expected},
+			}, getSDConfig(cfg).Selectors)
+
+			assertNoSelectorRLCs(t, cfg.ScrapeConfigs[0])
+
+			_, err := Normalize(cfg)
+			require.NoError(t, err, "selectors were not accepted by the agent")
+		})
+
+		t.Run("Selector Pushdown Disabled", func(t *testing.T) {
+			noPushdown := *sut
+			noPushdown.selectorPushdown = false
+
+			cfg, _, _ := noPushdown.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "dummy",
+					Namespace: "myapp",
+				},
+				Spec: v1.ServiceMonitorSpec{
+					Endpoints: []v1.Endpoint{},
+					Selector: metav1.LabelSelector{
+						MatchLabels: map[string]string{"z": "1"},
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{Operator: metav1.LabelSelectorOpDoesNotExist, Key: "notexists"},
+						},
+					},
+				},
+			}, v1.Endpoint{}, 0)
+
+			assert.Empty(t, getSDConfig(cfg).Selectors)
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_z", "^(?:1)$")
 			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Drop, "__meta_kubernetes_service_labelpresent_notexists", "^(?:true)$")
 		})
 
+		t.Run("Match Expressions Fallback", func(t *testing.T) {
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "dummy",
+					Namespace: "myapp",
+				},
+				Spec: v1.ServiceMonitorSpec{
+					Endpoints: []v1.Endpoint{},
+					Selector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Operator: metav1.LabelSelectorOpIn, Key: "in/a/b", Values: []string{"a", "b"}},
+						{Operator: metav1.LabelSelectorOpNotIn, Key: "notin", Values: []string{"c.*", "d"}},
+						{Operator: metav1.LabelSelectorOpExists, Key: "exists/a/b"},
+						{Operator: metav1.LabelSelectorOpDoesNotExist, Key: "notexists/a/b"},
+					}},
+				},
+			}, v1.Endpoint{}, 0)
+
+			assert.Empty(t, getSDConfig(cfg).Selectors)
+
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_label_in_a_b", "^(?:a|b)$")
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Drop, "__meta_kubernetes_service_label_notin", "^(?:c.*|d)$")
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_service_labelpresent_exists_a_b", "^(?:true)$")
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Drop, "__meta_kubernetes_service_labelpresent_notexists_a_b", "^(?:true)$")
+		})
+
 		t.Run("Port", func(t *testing.T) {
 			t.Run("Set", func(t *testing.T) {
 				cfg := genConfig(sut, v1.Endpoint{Port: "metrics"})
@@ -317,14 +410,14 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 					v := intstr.FromString("metrics")
 					cfg := genConfig(sut, v1.Endpoint{TargetPort: &v})
 
-					assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_endpoint_port_name", "^(?:metrics)$")
+					assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_pod_container_port_name", "^(?:metrics)$")
 				})
 
 				t.Run("Int", func(t *testing.T) {
 					v := intstr.FromInt(9000)
 					cfg := genConfig(sut, v1.Endpoint{TargetPort: &v})
 
-					assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_endpoint_port_number", "^(?:9000)$")
+					assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_pod_container_port_number", "^(?:9000)$")
 				})
 			})
 
@@ -380,7 +473,7 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 		}
 
 		t.Run("Target Labels", func(t *testing.T) {
-			cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "dummy",
 					Namespace: "myapp",
@@ -397,7 +490,7 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 		})
 
 		t.Run("Pod Labels", func(t *testing.T) {
-			cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "dummy",
 					Namespace: "myapp",
@@ -424,7 +517,7 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 		})
 
 		t.Run("Job Label", func(t *testing.T) {
-			cfg := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(&v1.ServiceMonitor{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "dummy",
 					Namespace: "myapp",
@@ -521,9 +614,876 @@ func TestMakeInstanceForServiceMonitor(t *testing.T) {
 		})
 
 		t.Run("Endpoint Metric RLC", func(t *testing.T) {
-			rlcCheck(t, genConfig(sut, v1.Endpoint{MetricRelabelConfigs: testRLCs}))
+			cfg := genConfig(sut, v1.Endpoint{MetricRelabelConfigs: testRLCs})
+			for _, rlc := range cfg.ScrapeConfigs[0].RelabelConfigs {
+				assert.False(t, rlcMatchSingle("s1")(rlc), "metricRelabelings were added to relabel_configs")
+			}
+
+			// Check the metric relabel configs the same way as the relabel configs
+			rlcCheck(t, &instance.Config{ScrapeConfigs: []*config.ScrapeConfig{
+				{RelabelConfigs: cfg.ScrapeConfigs[0].MetricRelabelConfigs},
+			}})
+		})
+
+		t.Run("RLC Defaults", func(t *testing.T) {
+			cfg := genConfig(sut, v1.Endpoint{RelabelConfigs: []*v1.RelabelConfig{{SourceLabels: []string{"s1"}, TargetLabel: "t1"}}})
+
+			assertRLCWith(t, cfg.ScrapeConfigs[0], rlcMatchSingle("s1"), func(t *testing.T, rlc *relabel.Config) {
+				assert.Equal(t, relabel.Replace, rlc.Action)
+				assert.Equal(t, ";", rlc.Separator)
+				assert.Equal(t, "$1", rlc.Replacement)
+				assert.Equal(t, "^(?:(.*))$", rlc.Regex.String())
+			})
+		})
+
+		t.Run("RLC Action Case", func(t *testing.T) {
+			cfg := genConfig(sut, v1.Endpoint{RelabelConfigs: []*v1.RelabelConfig{
+				{SourceLabels: []string{"s1"}, TargetLabel: "t1", Action: "Replace"},
+				{SourceLabels: []string{"s2"}, TargetLabel: "t2", Action: "HashMod", Modulus: 4},
+				{Regex: "(.+)", Action: "LabelMap"},
+			}})
+
+			assertRLCWith(t, cfg.ScrapeConfigs[0], rlcMatchSingle("s1"), func(t *testing.T, rlc *relabel.Config) {
+				assert.Equal(t, relabel.Replace, rlc.Action)
+			})
+			assertRLCWith(t, cfg.ScrapeConfigs[0], rlcMatchSingle("s2"), func(t *testing.T, rlc *relabel.Config) {
+				assert.Equal(t, relabel.HashMod, rlc.Action)
+			})
+			assertRLCWith(t, cfg.ScrapeConfigs[0], func(rlc *relabel.Config) bool {
+				return rlc.Action == relabel.LabelMap
+			}, func(_ *testing.T, _ *relabel.Config) {})
+
+			_, err := Normalize(cfg)
+			require.NoError(t, err)
+		})
+
+		t.Run("Invalid RLC", func(t *testing.T) {
+			tests := []struct {
+				name     string
+				rlc      *v1.RelabelConfig
+				expected string
+			}{
+				{
+					name:     "Unknown Action",
+					rlc:      &v1.RelabelConfig{Action: "explode"},
+					expected: `spec.endpoints[0].relabelings[0].action: Unsupported value: "explode"`,
+				},
+				{
+					name:     "HashMod Without Modulus",
+					rlc:      &v1.RelabelConfig{SourceLabels: []string{"__address__"}, TargetLabel: "shard", Action: "hashmod"},
+					expected: "spec.endpoints[0].relabelings[0].modulus: Required value: required for the hashmod action",
+				},
+				{
+					name:     "Invalid Regex",
+					rlc:      &v1.RelabelConfig{Regex: "(unclosed", Action: "keep"},
+					expected: `spec.endpoints[0].relabelings[0].regex: Invalid value: "(unclosed"`,
+				},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					_, _, err := sut.ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
+						ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+						Spec: v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{
+							{RelabelConfigs: []*v1.RelabelConfig{tt.rlc}},
+						}},
+					})
+
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), tt.expected)
+				})
+			}
+		})
+
+		t.Run("Invalid Regexes", func(t *testing.T) {
+			targetPort := intstr.FromString("web(")
+			tests := []struct {
+				name     string
+				selector metav1.LabelSelector
+				endpoint v1.Endpoint
+				expected string
+			}{
+				{
+					name:     "Port",
+					endpoint: v1.Endpoint{Port: "web("},
+					expected: `spec.endpoints[0].port: Invalid value: "web("`,
+				},
+				{
+					name:     "Target Port",
+					endpoint: v1.Endpoint{TargetPort: &targetPort},
+					expected: `spec.endpoints[0].targetPort: Invalid value: "web("`,
+				},
+				{
+					name:     "Match Labels",
+					selector: metav1.LabelSelector{MatchLabels: map[string]string{"a/b/c": "a("}},
+					expected: `spec.selector.matchLabels[a/b/c]: Invalid value: "a("`,
+				},
+				{
+					name: "Match Expressions",
+					selector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Operator: metav1.LabelSelectorOpExists, Key: "app"},
+						{Operator: metav1.LabelSelectorOpIn, Key: "tier", Values: []string{"a("}},
+					}},
+					expected: `spec.selector.matchExpressions[1].values: Invalid value: "a("`,
+				},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					var err error
+					require.NotPanics(t, func() {
+						_, _, err = sut.ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
+							ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+							Spec: v1.ServiceMonitorSpec{
+								Selector:  tt.selector,
+								Endpoints: []v1.Endpoint{tt.endpoint},
+							},
+						})
+					})
+
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), tt.expected)
+				})
+			}
+		})
+	})
+}
+
+func TestDiscoveryRole(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	rwc := &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}
+
+	tests := []struct {
+		role   kubernetes.Role
+		prefix string
+	}{
+		{role: kubernetes.RoleEndpoint, prefix: "__meta_kubernetes_endpoint_"},
+		{role: kubernetes.RoleEndpointSlice, prefix: "__meta_kubernetes_endpointslice_"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			sut := NewWriter(rwc, WithDiscoveryRole(tt.role))
+
+			sm := &v1.ServiceMonitor{
+				ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+				Spec: v1.ServiceMonitorSpec{
+					Selector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "dummy"}},
+				},
+			}
+
+			cfg, _, _ := sut.makeInstanceForServiceMonitorEndpoint(sm, v1.Endpoint{Port: "metrics"}, 0)
+			sd := getSDConfig(cfg)
+			assert.Equal(t, tt.role, sd.Role)
+			assert.Equal(t, []kubernetes.SelectorConfig{
+				{Role: tt.role, Label: "app=dummy"},
+				{Role: kubernetes.RoleService, Label: "app=dummy"},
+			}, sd.Selectors)
+
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, tt.prefix+"port_name", "^(?:metrics)$")
+			assertRLCWith(t, cfg.ScrapeConfigs[0], func(rlc *relabel.Config) bool {
+				return len(rlc.SourceLabels) == 2 &&
+					string(rlc.SourceLabels[0]) == tt.prefix+"address_target_kind" &&
+					string(rlc.SourceLabels[1]) == tt.prefix+"address_target_name" &&
+					rlc.TargetLabel == "pod"
+			}, func(t *testing.T, rlc *relabel.Config) {})
+
+			port := intstr.FromInt(9000)
+			cfg, _, _ = sut.makeInstanceForServiceMonitorEndpoint(sm, v1.Endpoint{TargetPort: &port}, 0)
+			assertRLC(t, cfg.ScrapeConfigs[0], relabel.Keep, "__meta_kubernetes_pod_container_port_number", "^(?:9000)$")
+
+			_, err := Normalize(cfg)
+			require.NoError(t, err, "config was not accepted by the agent")
+		})
+	}
+}
+
+func TestAPIServer(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	rwc := &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}
+
+	t.Run("Not Set", func(t *testing.T) {
+		cfg := genConfig(NewWriter(rwc), v1.Endpoint{})
+		sd := getSDConfig(cfg)
+
+		assert.Nil(t, sd.APIServer.URL)
+		assert.Equal(t, commonconfig.HTTPClientConfig{}, sd.HTTPClientConfig)
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		apiServer, _ := url.Parse("https://cluster-a.example.com:6443")
+		sut := NewWriter(rwc, WithAPIServer(APIServer{
+			URL:        apiServer,
+			CAFile:     "/etc/cluster-a/ca.crt",
+			ServerName: "kubernetes",
+		}), WithAPIServerBearerToken("hunter2"))
+
+		cfg := genConfig(sut, v1.Endpoint{})
+		sd := getSDConfig(cfg)
+
+		assert.Equal(t, "https://cluster-a.example.com:6443", sd.APIServer.String())
+		assert.Equal(t, commonconfig.HTTPClientConfig{
+			BearerToken: "hunter2",
+			TLSConfig: commonconfig.TLSConfig{
+				CAFile:     "/etc/cluster-a/ca.crt",
+				ServerName: "kubernetes",
+			},
+		}, sd.HTTPClientConfig)
+
+		raw, err := instance.MarshalConfig(cfg, false)
+		require.NoError(t, err)
+		assert.Contains(t, string(raw), "bearer_token: hunter2")
+
+		_, err = Normalize(cfg)
+		require.NoError(t, err, "config was not accepted by the agent")
+	})
+}
+
+func TestValidate(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	sut := NewWriter(&instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}})
+
+	makeSM := func(mutate func(sm *v1.ServiceMonitor)) *v1.ServiceMonitor {
+		sm := &v1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+			Spec: v1.ServiceMonitorSpec{
+				Endpoints: []v1.Endpoint{{Port: "metrics"}},
+			},
+		}
+		mutate(sm)
+
+		return sm
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(sm *v1.ServiceMonitor)
+		expected []string
+	}{
+		{name: "Valid", mutate: func(sm *v1.ServiceMonitor) {
+			sm.Spec.Endpoints[0].Interval = "30s"
+			sm.Spec.Endpoints[0].ScrapeTimeout = "10s"
+			sm.Spec.Endpoints[0].RelabelConfigs = []*v1.RelabelConfig{
+				{SourceLabels: []string{"__meta_kubernetes_pod_node_name"}, TargetLabel: "node"},
+				{Action: "HashMod", SourceLabels: []string{"__address__"}, Modulus: 4, TargetLabel: "__tmp_hash"},
+				{Action: "labeldrop", Regex: "__tmp_.*"},
+			}
+		}},
+		{
+			name: "Invalid Durations",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Endpoints[0].Interval = "soon"
+				sm.Spec.Endpoints[0].ScrapeTimeout = "0s"
+			},
+			expected: []string{
+				`spec.endpoints[0].interval: Invalid value: "soon"`,
+				`spec.endpoints[0].scrapeTimeout: Invalid value: "0s": must be greater than 0`,
+			},
+		},
+		{
+			name: "Timeout Greater Than Interval",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Endpoints = append(sm.Spec.Endpoints, v1.Endpoint{Port: "metrics", Interval: "10s", ScrapeTimeout: "30s"})
+			},
+			expected: []string{`spec.endpoints[1].scrapeTimeout: Invalid value: "30s": must not be greater than the scrape interval of 10s`},
+		},
+		{
+			name: "Timeout Greater Than Default Interval",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Endpoints[0].ScrapeTimeout = "2m"
+			},
+			expected: []string{`spec.endpoints[0].scrapeTimeout: Invalid value: "2m": must not be greater than the scrape interval of 1m`},
+		},
+		{
+			name: "Invalid Relabelings",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Endpoints[0].RelabelConfigs = []*v1.RelabelConfig{
+					{Action: "explode"},
+					{Regex: "(unclosed", TargetLabel: "a"},
+					{Action: "hashmod", TargetLabel: "shard"},
+				}
+				sm.Spec.Endpoints[0].MetricRelabelConfigs = []*v1.RelabelConfig{
+					{Regex: "(unclosed", TargetLabel: "a"},
+				}
+			},
+			expected: []string{
+				`spec.endpoints[0].relabelings[0].action: Unsupported value: "explode"`,
+				`spec.endpoints[0].relabelings[1].regex: Invalid value: "(unclosed"`,
+				`spec.endpoints[0].relabelings[2].modulus: Required value`,
+				`spec.endpoints[0].metricRelabelings[0].regex: Invalid value: "(unclosed"`,
+			},
+		},
+		{
+			name: "Invalid Target Label",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Endpoints[0].RelabelConfigs = []*v1.RelabelConfig{
+					{Action: "replace", TargetLabel: "not-a-label"},
+				}
+			},
+			expected: []string{`spec.endpoints[0]: Invalid value: "myapp/dummy/0": rejected by the agent`, `"not-a-label" is invalid 'target_label'`},
+		},
+		{
+			name: "Invalid Label Keep",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Endpoints[0].MetricRelabelConfigs = []*v1.RelabelConfig{
+					{Action: "labelkeep", Regex: "a", TargetLabel: "b"},
+				}
+			},
+			expected: []string{`spec.endpoints[0]: Invalid value: "myapp/dummy/0": rejected by the agent`, `labelkeep action requires only 'regex'`},
+		},
+		{
+			name: "Invalid Fallback Selector",
+			mutate: func(sm *v1.ServiceMonitor) {
+				sm.Spec.Selector.MatchLabels = map[string]string{"a/b/c": "(unclosed"}
+			},
+			expected: []string{`spec.selector.matchLabels[a/b/c]: Invalid value: "(unclosed"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sut.Validate(makeSM(tt.mutate))
+			if len(tt.expected) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			for _, expected := range tt.expected {
+				assert.Contains(t, err.Error(), expected)
+			}
+		})
+	}
+
+	t.Run("Remote Write URL Not Set", func(t *testing.T) {
+		err := NewWriter(&instance.RemoteWriteConfig{}).Validate(makeSM(func(*v1.ServiceMonitor) {}))
+		require.EqualError(t, err, "no remote write URL is configured")
+	})
+}
+
+func TestLimits(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	sut := NewWriter(&instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}, WithLimits(Limits{
+		DefaultInterval: model.Duration(30 * time.Second),
+		DefaultTimeout:  model.Duration(10 * time.Second),
+		MinInterval:     model.Duration(15 * time.Second),
+		MaxSampleLimit:  1000,
+		MaxTargetLimit:  10,
+	}))
+
+	gen := func(spec v1.ServiceMonitorSpec) (*config.ScrapeConfig, []string) {
+		configs, warnings, err := sut.ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "dummy",
+				Namespace: "myapp",
+			},
+			Spec: spec,
+		})
+
+		require.NoError(t, err)
+		require.Len(t, configs, 1)
+		return configs[0].ScrapeConfigs[0], warnings
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		sc, warnings := gen(v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{{}}})
+
+		assert.Empty(t, warnings)
+		assert.Equal(t, "30s", sc.ScrapeInterval.String())
+		assert.Equal(t, "10s", sc.ScrapeTimeout.String())
+		assert.Equal(t, uint(1000), sc.SampleLimit)
+		assert.Equal(t, uint(10), sc.TargetLimit)
+	})
+
+	t.Run("Minimum Above Agent Default", func(t *testing.T) {
+		l := Limits{MinInterval: model.Duration(2 * time.Minute)}
+		sc := &config.ScrapeConfig{}
+
+		assert.Empty(t, l.apply(sc))
+		assert.Equal(t, "2m", sc.ScrapeInterval.String())
+	})
+
+	t.Run("Minimum Below Agent Default", func(t *testing.T) {
+		l := Limits{MinInterval: model.Duration(15 * time.Second)}
+		sc := &config.ScrapeConfig{}
+
+		assert.Empty(t, l.apply(sc))
+		assert.Zero(t, sc.ScrapeInterval)
+	})
+
+	t.Run("Default Timeout Longer Than Interval", func(t *testing.T) {
+		l := Limits{DefaultTimeout: model.Duration(10 * time.Second)}
+		sc := &config.ScrapeConfig{ScrapeInterval: model.Duration(5 * time.Second)}
+
+		assert.Empty(t, l.apply(sc))
+		assert.Zero(t, sc.ScrapeTimeout)
+	})
+
+	t.Run("Within Limits", func(t *testing.T) {
+		sc, warnings := gen(v1.ServiceMonitorSpec{
+			Endpoints:   []v1.Endpoint{{Interval: "1m", ScrapeTimeout: "30s"}},
+			SampleLimit: 500,
+			TargetLimit: 5,
+		})
+
+		assert.Empty(t, warnings)
+		assert.Equal(t, "1m", sc.ScrapeInterval.String())
+		assert.Equal(t, "30s", sc.ScrapeTimeout.String())
+		assert.Equal(t, uint(500), sc.SampleLimit)
+		assert.Equal(t, uint(5), sc.TargetLimit)
+	})
+
+	t.Run("Clamped", func(t *testing.T) {
+		sc, warnings := gen(v1.ServiceMonitorSpec{
+			Endpoints:   []v1.Endpoint{{Interval: "1s", ScrapeTimeout: "1s"}},
+			SampleLimit: 5000,
+			TargetLimit: 50,
+		})
+
+		assert.Equal(t, []string{
+			"myapp/dummy/0: interval 1s is below the minimum of 15s, using 15s instead",
+			"myapp/dummy/0: sampleLimit 5000 exceeds the maximum of 1000, using 1000 instead",
+			"myapp/dummy/0: targetLimit 50 exceeds the maximum of 10, using 10 instead",
+		}, warnings)
+		assert.Equal(t, "15s", sc.ScrapeInterval.String())
+		assert.Equal(t, "1s", sc.ScrapeTimeout.String())
+		assert.Equal(t, uint(1000), sc.SampleLimit)
+		assert.Equal(t, uint(10), sc.TargetLimit)
+	})
+}
+
+func TestInstanceSettings(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	rwc := &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}
+	sut := NewWriter(rwc, WithInstanceSettings(InstanceSettings{
+		WALTruncateFrequency: 15 * time.Minute,
+		MaxWALTime:           time.Hour,
+		WriteStaleOnShutdown: true,
+	}))
+
+	gen := func(annotations map[string]string) (*instance.Config, error) {
+		configs, _, err := sut.ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp", Annotations: annotations},
+			Spec:       v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{{Port: "metrics"}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		require.Len(t, configs, 1)
+		return configs[0], nil
+	}
+
+	t.Run("Agent Defaults", func(t *testing.T) {
+		configs, _, err := NewWriter(rwc).ScrapeConfigsForServiceMonitor(&v1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+			Spec:       v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{{Port: "metrics"}}},
 		})
+		require.NoError(t, err)
+
+		cfg, err := applyAgentDefaults(configs[0])
+		require.NoError(t, err)
+		assert.Equal(t, instance.DefaultConfig.WALTruncateFrequency, cfg.WALTruncateFrequency)
+		assert.Equal(t, instance.DefaultConfig.MinWALTime, cfg.MinWALTime)
+		assert.Equal(t, instance.DefaultConfig.MaxWALTime, cfg.MaxWALTime)
+		assert.Equal(t, instance.DefaultConfig.RemoteFlushDeadline, cfg.RemoteFlushDeadline)
+		assert.False(t, cfg.WriteStaleOnShutdown)
+	})
+
+	t.Run("Operator Defaults", func(t *testing.T) {
+		cfg, err := gen(nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, 15*time.Minute, cfg.WALTruncateFrequency)
+		assert.Zero(t, cfg.MinWALTime)
+		assert.Equal(t, time.Hour, cfg.MaxWALTime)
+		assert.Zero(t, cfg.RemoteFlushDeadline)
+		assert.True(t, cfg.WriteStaleOnShutdown)
 	})
+
+	t.Run("Annotation Overrides", func(t *testing.T) {
+		cfg, err := gen(map[string]string{
+			AnnotationWALTruncateFrequency: "5m",
+			AnnotationMinWALTime:           "10m",
+			AnnotationMaxWALTime:           "2h",
+			AnnotationRemoteFlushDeadline:  "30s",
+			AnnotationWriteStaleOnShutdown: "false",
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, 5*time.Minute, cfg.WALTruncateFrequency)
+		assert.Equal(t, 10*time.Minute, cfg.MinWALTime)
+		assert.Equal(t, 2*time.Hour, cfg.MaxWALTime)
+		assert.Equal(t, 30*time.Second, cfg.RemoteFlushDeadline)
+		assert.False(t, cfg.WriteStaleOnShutdown)
+
+		_, err = applyAgentDefaults(cfg)
+		require.NoError(t, err)
+	})
+
+	t.Run("Invalid Annotations", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			annotations map[string]string
+			expected    string
+		}{
+			{
+				name:        "Invalid Duration",
+				annotations: map[string]string{AnnotationMinWALTime: "soon"},
+				expected:    `metadata.annotations[grafana-agent-operator/min-wal-time]: Invalid value: "soon"`,
+			},
+			{
+				name:        "Not Positive",
+				annotations: map[string]string{AnnotationRemoteFlushDeadline: "0s"},
+				expected:    `metadata.annotations[grafana-agent-operator/remote-flush-deadline]: Invalid value: "0s": must be greater than 0`,
+			},
+			{
+				name:        "Invalid Bool",
+				annotations: map[string]string{AnnotationWriteStaleOnShutdown: "sometimes"},
+				expected:    `metadata.annotations[grafana-agent-operator/write-stale-on-shutdown]: Invalid value: "sometimes": must be true or false`,
+			},
+			{
+				name:        "Min Greater Than Max",
+				annotations: map[string]string{AnnotationMinWALTime: "2h"},
+				expected:    `metadata.annotations[grafana-agent-operator/min-wal-time]: Invalid value: "2h0m0s": must not be greater than the max WAL time of 1h0m0s`,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := gen(tt.annotations)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expected)
+			})
+		}
+	})
+
+	t.Run("Interval Longer Than Truncate Frequency", func(t *testing.T) {
+		err := sut.Validate(&v1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "dummy",
+				Namespace:   "myapp",
+				Annotations: map[string]string{AnnotationWALTruncateFrequency: "1m"},
+			},
+			Spec: v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{{Port: "metrics", Interval: "2m"}}},
+		})
+
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `spec.endpoints[0].interval: Invalid value: "2m": must not be greater than the WAL truncate frequency of 1m0s`)
+	})
+}
+
+func TestHostFilter(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	rwc := &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}
+	sm := &v1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec:       v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{{Port: "a"}, {Port: "b"}}},
+	}
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			configs, _, err := NewWriter(rwc, WithHostFilter(enabled)).ScrapeConfigsForServiceMonitor(sm)
+			require.NoError(t, err)
+			require.Len(t, configs, 2)
+
+			for _, cfg := range configs {
+				assert.Equal(t, enabled, cfg.HostFilter)
+
+				raw, err := instance.MarshalConfig(cfg, false)
+				require.NoError(t, err)
+				assert.Contains(t, string(raw), fmt.Sprintf("host_filter: %t", enabled))
+			}
+		})
+	}
+}
+
+func TestStaticLabels(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	rwc := &instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}}
+
+	namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp", Labels: map[string]string{"example.com/team": "a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other", Labels: map[string]string{"example.com/team": "b"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "unowned"}},
+	} {
+		require.NoError(t, namespaces.Add(ns))
+	}
+	lister := corelisters.NewNamespaceLister(namespaces)
+
+	sm := &v1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: v1.ServiceMonitorSpec{
+			TargetLabels:      []string{"cluster"},
+			NamespaceSelector: v1.NamespaceSelector{Any: true},
+			Endpoints:         []v1.Endpoint{{Port: "metrics"}},
+		},
+	}
+
+	// relabelTarget applies the relabel rules of the generated config, as loaded by the agent, to a target
+	relabelTarget := func(t *testing.T, sut *writer, target map[string]string) labels.Labels {
+		cfgs, _, err := sut.ScrapeConfigsForServiceMonitor(sm)
+		require.NoError(t, err)
+
+		cfg, err := applyAgentDefaults(cfgs[0])
+		require.NoError(t, err, "config was not accepted by the agent")
+
+		lbls := labels.FromMap(map[string]string{
+			"__meta_kubernetes_endpoint_port_name": "metrics",
+			"__meta_kubernetes_service_name":       "svc",
+		})
+		for k, v := range target {
+			lbls = append(lbls, labels.Label{Name: k, Value: v})
+		}
+		sort.Sort(lbls)
+
+		return relabel.Process(lbls, cfg.ScrapeConfigs[0].RelabelConfigs...)
+	}
+
+	static := StaticLabels{Labels: map[string]string{"cluster": "prod", "cost_center": "cost$1"}}
+
+	t.Run("Override", func(t *testing.T) {
+		sut := NewWriter(rwc, WithStaticLabels(static))
+
+		result := relabelTarget(t, sut, map[string]string{
+			"__meta_kubernetes_namespace":             "myapp",
+			"__meta_kubernetes_service_label_cluster": "from-service",
+		})
+		assert.Equal(t, "prod", result.Get("cluster"))
+		assert.Equal(t, "cost$1", result.Get("cost_center"), "values should not be expanded")
+	})
+
+	t.Run("Override Metric Relabelings", func(t *testing.T) {
+		s := static
+		s.NamespaceLabels = map[string]string{"team": "example.com/team"}
+		sut := NewWriter(rwc, WithStaticLabels(s), WithNamespaceLister(lister))
+
+		relabeled := sm.DeepCopy()
+		relabeled.Spec.Endpoints[0].MetricRelabelConfigs = []*v1.RelabelConfig{
+			{TargetLabel: "cluster", Replacement: "from-metric"},
+			{TargetLabel: "team", Replacement: "from-metric"},
+		}
+		cfgs, _, err := sut.ScrapeConfigsForServiceMonitor(relabeled)
+		require.NoError(t, err)
+		cfg, err := applyAgentDefaults(cfgs[0])
+		require.NoError(t, err, "config was not accepted by the agent")
+
+		// Series get the labels of their target before metric relabeling
+		result := relabel.Process(labels.FromMap(map[string]string{
+			"__name__":    "up",
+			"namespace":   "myapp",
+			"cluster":     "prod",
+			"cost_center": "cost$1",
+			"team":        "a",
+		}), cfg.ScrapeConfigs[0].MetricRelabelConfigs...)
+		assert.Equal(t, "prod", result.Get("cluster"))
+		assert.Equal(t, "a", result.Get("team"))
+	})
+
+	t.Run("Keep", func(t *testing.T) {
+		keep := static
+		keep.ConflictPolicy = LabelConflictKeep
+		sut := NewWriter(rwc, WithStaticLabels(keep))
+
+		result := relabelTarget(t, sut, map[string]string{
+			"__meta_kubernetes_namespace":             "myapp",
+			"__meta_kubernetes_service_label_cluster": "from-service",
+		})
+		assert.Equal(t, "from-service", result.Get("cluster"))
+		assert.Equal(t, "cost$1", result.Get("cost_center"))
+
+		result = relabelTarget(t, sut, map[string]string{"__meta_kubernetes_namespace": "myapp"})
+		assert.Equal(t, "prod", result.Get("cluster"))
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		reject := static
+		reject.ConflictPolicy = LabelConflictReject
+		sut := NewWriter(rwc, WithStaticLabels(reject))
+
+		err := sut.Validate(sm)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `spec.targetLabels[0]: Invalid value: "cluster": sets the label cluster, which is set by the operator`)
+
+		relabeled := sm.DeepCopy()
+		relabeled.Spec.TargetLabels = nil
+		relabeled.Spec.Endpoints[0].RelabelConfigs = []*v1.RelabelConfig{{TargetLabel: "cost_center", Replacement: "other"}}
+		err = sut.Validate(relabeled)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `spec.endpoints[0].relabelings[0].targetLabel: Invalid value: "cost_center"`)
+
+		relabeled.Spec.Endpoints[0].RelabelConfigs = nil
+		assert.NoError(t, sut.Validate(relabeled))
+	})
+
+	t.Run("Namespace Labels", func(t *testing.T) {
+		s := StaticLabels{NamespaceLabels: map[string]string{"team": "example.com/team"}}
+
+		sut := NewWriter(rwc, WithStaticLabels(s), WithNamespaceLister(lister))
+		for ns, expected := range map[string]string{"myapp": "a", "other": "b", "unowned": ""} {
+			result := relabelTarget(t, sut, map[string]string{
+				"__meta_kubernetes_namespace":      ns,
+				"__meta_kubernetes_pod_label_team": "from-pod",
+			})
+			assert.Equal(t, expected, result.Get("team"), ns)
+		}
+
+		s.ConflictPolicy = LabelConflictKeep
+		sut = NewWriter(rwc, WithStaticLabels(s), WithNamespaceLister(lister))
+		withPodLabel := sm.DeepCopy()
+		withPodLabel.Spec.PodTargetLabels = []string{"team"}
+		cfgs, _, err := sut.ScrapeConfigsForServiceMonitor(withPodLabel)
+		require.NoError(t, err)
+		cfg, err := applyAgentDefaults(cfgs[0])
+		require.NoError(t, err)
+
+		result := relabel.Process(labels.FromMap(map[string]string{
+			"__meta_kubernetes_endpoint_port_name": "metrics",
+			"__meta_kubernetes_namespace":          "myapp",
+			"__meta_kubernetes_pod_label_team":     "from-pod",
+		}), cfg.ScrapeConfigs[0].RelabelConfigs...)
+		assert.Equal(t, "from-pod", result.Get("team"))
+	})
+
+	t.Run("Namespace Labels From Selected Namespaces", func(t *testing.T) {
+		sut := NewWriter(rwc, WithStaticLabels(StaticLabels{NamespaceLabels: map[string]string{"team": "example.com/team"}}), WithNamespaceLister(lister))
+
+		selected := sm.DeepCopy()
+		selected.Spec.NamespaceSelector = v1.NamespaceSelector{MatchNames: []string{"other", "missing"}}
+		cfgs, _, err := sut.ScrapeConfigsForServiceMonitor(selected)
+		require.NoError(t, err)
+
+		var teams []string
+		for _, rlc := range cfgs[0].ScrapeConfigs[0].RelabelConfigs {
+			if rlc.TargetLabel == "team" {
+				teams = append(teams, rlc.Regex.String()+"="+rlc.Replacement)
+			}
+		}
+		assert.Equal(t, []string{"^(?:other)$=b"}, teams)
+	})
+
+	t.Run("Without Namespace Lister", func(t *testing.T) {
+		sut := NewWriter(rwc, WithStaticLabels(StaticLabels{NamespaceLabels: map[string]string{"team": "example.com/team"}}))
+
+		result := relabelTarget(t, sut, map[string]string{"__meta_kubernetes_namespace": "myapp"})
+		assert.Empty(t, result.Get("team"))
+	})
+}
+
+func TestParseLabelPairs(t *testing.T) {
+	result, err := ParseLabelPairs([]string{"cluster=prod,region=eu-west-1", " env = staging ", "empty="})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cluster": "prod", "region": "eu-west-1", "env": "staging", "empty": ""}, result)
+
+	_, err = ParseLabelPairs([]string{"cluster"})
+	assert.EqualError(t, err, "expected name=value, got 'cluster'")
+}
+
+func TestNormalize(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	sut := NewWriter(&instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}})
+
+	cfg := genConfig(sut, v1.Endpoint{Port: "metrics", BearerTokenFile: "/foo/bar.token"})
+	expected, err := Normalize(cfg)
+	require.NoError(t, err)
+
+	t.Run("Does Not Modify Config", func(t *testing.T) {
+		assert.Zero(t, cfg.ScrapeConfigs[0].ScrapeInterval)
+		assert.Empty(t, cfg.RemoteWrite[0].Base.Name)
+	})
+
+	t.Run("Stable Across Agent Round Trip", func(t *testing.T) {
+		// The agent applies defaults before storing a config and returns it with secrets scrubbed
+		stored, err := instance.UnmarshalConfig(strings.NewReader(expected))
+		require.NoError(t, err)
+
+		actual, err := Normalize(stored)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	})
+}
+
+func TestDiff(t *testing.T) {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	sut := NewWriter(&instance.RemoteWriteConfig{Base: config.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}})
+
+	cfg := genConfig(sut, v1.Endpoint{Port: "metrics"})
+
+	t.Run("Equivalent", func(t *testing.T) {
+		diff, err := Diff(cfg.Name, cfg, genConfig(sut, v1.Endpoint{Port: "metrics"}))
+		require.NoError(t, err)
+		assert.Empty(t, diff)
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		diff, err := Diff(cfg.Name, cfg, genConfig(sut, v1.Endpoint{Port: "metrics", Path: "/foo"}))
+		require.NoError(t, err)
+		assert.Contains(t, diff, "--- agent/myapp/dummy/0\n+++ desired/myapp/dummy/0\n")
+		assert.Contains(t, diff, "-  metrics_path: /metrics\n+  metrics_path: /foo\n")
+	})
+
+	t.Run("Created", func(t *testing.T) {
+		diff, err := Diff(cfg.Name, nil, cfg)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(diff, "--- /dev/null\n+++ desired/myapp/dummy/0\n"))
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		diff, err := Diff(cfg.Name, cfg, nil)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(diff, "--- agent/myapp/dummy/0\n+++ /dev/null\n"))
+	})
+}
+
+func TestParseInstanceName(t *testing.T) {
+	tests := []struct {
+		name           string
+		namespace      string
+		serviceMonitor string
+		endpointNumber int
+		ok             bool
+	}{
+		{name: "myapp/dummy/0", namespace: "myapp", serviceMonitor: "dummy", endpointNumber: 0, ok: true},
+		{name: "myapp/dummy/12", namespace: "myapp", serviceMonitor: "dummy", endpointNumber: 12, ok: true},
+		{name: "myapp/dummy"},
+		{name: "myapp/dummy/a"},
+		{name: "myapp/dummy/-1"},
+		{name: "/dummy/0"},
+		{name: "a/b/c/0"},
+		{name: "something-else"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, serviceMonitor, endpointNumber, ok := ParseInstanceName(tt.name)
+
+			require.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.namespace, namespace)
+			assert.Equal(t, tt.serviceMonitor, serviceMonitor)
+			assert.Equal(t, tt.endpointNumber, endpointNumber)
+		})
+	}
+}
+
+func TestInstanceNames(t *testing.T) {
+	sm := &v1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: v1.ServiceMonitorSpec{Endpoints: []v1.Endpoint{
+			{Port: "metrics"},
+			{Port: "other", RelabelConfigs: []*v1.RelabelConfig{{Action: "explode"}}},
+		}},
+	}
+
+	assert.Equal(t, []string{"myapp/dummy/0", "myapp/dummy/1"}, InstanceNames(sm))
+}
+
+func assertNoSelectorRLCs(t *testing.T, sc *config.ScrapeConfig) {
+	for _, rlc := range sc.RelabelConfigs {
+		for _, l := range rlc.SourceLabels {
+			if strings.HasPrefix(string(l), "__meta_kubernetes_service_label") && (rlc.Action == relabel.Keep || rlc.Action == relabel.Drop) {
+				t.Errorf("unexpected relabel rule filtering on %s", l)
+			}
+		}
+	}
 }
 
 func rlcMatchSingle(source string) func(rlc *relabel.Config) bool {
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var relabelActions = []string{
+	string(relabel.Replace),
+	string(relabel.Keep),
+	string(relabel.Drop),
+	string(relabel.HashMod),
+	string(relabel.LabelMap),
+	string(relabel.LabelDrop),
+	string(relabel.LabelKeep),
+}
+
+// Validate checks that the configs generated for sm will be accepted by the agent, applying the same defaults
+// and validation the agent does. Errors refer to the fields of the ServiceMonitor that caused them.
+func (w *writer) Validate(sm *v1.ServiceMonitor) error {
+	if w.rwc == nil || w.rwc.Base.URL == nil || w.rwc.Base.URL.URL == nil || w.rwc.Base.URL.String() == "" {
+		return fmt.Errorf("no remote write URL is configured")
+	}
+
+	// The spec has to be valid before configs can be generated from it
+	if errs := w.validateServiceMonitorSpec(sm); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+
+	var errs field.ErrorList
+	cfgs, _, err := w.ScrapeConfigsForServiceMonitor(sm)
+	if err != nil {
+		return err
+	}
+
+	jobNames := map[string]struct{}{}
+	for i, cfg := range cfgs {
+		path := field.NewPath("spec", "endpoints").Index(i)
+
+		for _, sc := range cfg.ScrapeConfigs {
+			if _, exists := jobNames[sc.JobName]; exists {
+				errs = append(errs, field.Duplicate(path, sc.JobName))
+			}
+			jobNames[sc.JobName] = struct{}{}
+
+			interval := sc.ScrapeInterval
+			if interval == 0 {
+				interval = config.DefaultGlobalConfig.ScrapeInterval
+			}
+
+			truncate := cfg.WALTruncateFrequency
+			if truncate == 0 {
+				truncate = instance.DefaultConfig.WALTruncateFrequency
+			}
+
+			if time.Duration(interval) > truncate {
+				errs = append(errs, field.Invalid(
+					path.Child("interval"), interval.String(),
+					fmt.Sprintf("must not be greater than the WAL truncate frequency of %s", truncate),
+				))
+			}
+
+			if sc.ScrapeTimeout > interval {
+				errs = append(errs, field.Invalid(
+					path.Child("scrapeTimeout"), sc.ScrapeTimeout.String(),
+					fmt.Sprintf("must not be greater than the scrape interval of %s", interval),
+				))
+			}
+		}
+
+		// Catch anything else the agent would reject
+		if _, err := applyAgentDefaults(cfg); err != nil && len(errs) == 0 {
+			errs = append(errs, field.Invalid(path, cfg.Name, fmt.Sprintf("rejected by the agent: %v", err)))
+		}
+	}
+
+	return errs.ToAggregate()
+}
+
+func (w *writer) validateServiceMonitorSpec(sm *v1.ServiceMonitor) field.ErrorList {
+	spec := field.NewPath("spec")
+
+	// Requirements that cannot be pushed down to service discovery are matched with regular expressions
+	_, errs := selectorRelabelConfigs(spec.Child("selector"), sm.Spec.Selector, w.selectorPushdown)
+
+	for i, ep := range sm.Spec.Endpoints {
+		path := spec.Child("endpoints").Index(i)
+
+		errs = append(errs, validateDuration(path.Child("interval"), ep.Interval)...)
+		errs = append(errs, validateDuration(path.Child("scrapeTimeout"), ep.ScrapeTimeout)...)
+
+		if _, err := w.portRelabelConfig(path, ep); err != nil {
+			errs = append(errs, err)
+		}
+
+		if ep.ProxyURL != nil {
+			if _, err := url.Parse(*ep.ProxyURL); err != nil {
+				errs = append(errs, field.Invalid(path.Child("proxyUrl"), *ep.ProxyURL, err.Error()))
+			}
+		}
+
+		_, relabelingErrs := makeRelabelConfigs(path.Child("relabelings"), ep.RelabelConfigs)
+		errs = append(errs, relabelingErrs...)
+
+		_, metricRelabelingErrs := makeRelabelConfigs(path.Child("metricRelabelings"), ep.MetricRelabelConfigs)
+		errs = append(errs, metricRelabelingErrs...)
+	}
+
+	return errs
+}
+
+func validateDuration(path *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+
+	if d, err := model.ParseDuration(value); err != nil {
+		return field.ErrorList{field.Invalid(path, value, err.Error())}
+	} else if d <= 0 {
+		return field.ErrorList{field.Invalid(path, value, "must be greater than 0")}
+	}
+
+	return nil
+}
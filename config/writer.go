@@ -2,52 +2,131 @@ package config
 
 import (
 	"regexp"
+	"strings"
 
 	"github.com/grafana/agent/pkg/prom/instance"
 	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/discovery/kubernetes"
 	"github.com/prometheus/prometheus/pkg/relabel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
 var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
 type Writer interface {
-	ScrapeConfigsForServiceMonitor(sm *v1.ServiceMonitor) []*instance.Config
+	// ScrapeConfigsForServiceMonitor renders an instance config for each endpoint of the ServiceMonitor. Any
+	// values the writer had to override to stay within the configured Limits are described in the returned
+	// warnings. An error is returned if the ServiceMonitor cannot be converted, for example because of an unknown
+	// relabel action.
+	ScrapeConfigsForServiceMonitor(sm *v1.ServiceMonitor) ([]*instance.Config, []string, error)
+
+	// Validate checks that the configs generated for the ServiceMonitor would be accepted by the agent. Errors
+	// refer to the fields of the ServiceMonitor that caused them.
+	Validate(sm *v1.ServiceMonitor) error
+}
+
+// Option customizes the configs produced by a writer
+type Option func(w *writer)
+
+// WithHostFilter enables host_filter on every generated instance config, so agents running as a DaemonSet only
+// scrape targets on their own node
+func WithHostFilter(enabled bool) Option {
+	return func(w *writer) {
+		w.hostFilter = enabled
+	}
 }
 
 type writer struct {
 	rwc *instance.RemoteWriteConfig
+
+	limits           Limits
+	role             kubernetes.Role
+	apiServer        APIServer
+	instanceSettings InstanceSettings
+	hostFilter       bool
+	selectorPushdown bool
+	staticLabels     StaticLabels
+	namespaces       corelisters.NamespaceLister
 }
 
-func NewWriter(rwc *instance.RemoteWriteConfig) *writer {
-	return &writer{rwc: rwc}
+func NewWriter(rwc *instance.RemoteWriteConfig, opts ...Option) *writer {
+	w := &writer{rwc: rwc, selectorPushdown: true}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	return w
 }
 
-func makeRelabelConfigs(rlcs []*v1.RelabelConfig) []*relabel.Config {
+// makeRelabelConfigs converts the relabel configs of a ServiceMonitor endpoint, applying the defaults Prometheus
+// applies to unset fields. Actions are case-insensitive, like they are for prometheus-operator. Anything else the
+// agent would reject is caught when the agent defaults are applied.
+func makeRelabelConfigs(path *field.Path, rlcs []*v1.RelabelConfig) ([]*relabel.Config, field.ErrorList) {
 	var results []*relabel.Config
+	var errs field.ErrorList
+
+	for i, c := range rlcs {
+		p := path.Index(i)
+		rlc := relabel.DefaultRelabelConfig
+		rlc.TargetLabel = c.TargetLabel
+		rlc.Modulus = c.Modulus
+
+		if c.Separator != "" {
+			rlc.Separator = c.Separator
+		}
+
+		if c.Replacement != "" {
+			rlc.Replacement = c.Replacement
+		}
 
-	for _, c := range rlcs {
-		rlc := &relabel.Config{
-			Replacement: c.Replacement,
-			TargetLabel: c.TargetLabel,
-			Separator:   c.Separator,
-			Action:      relabel.Action(c.Action),
-			Modulus:     c.Modulus,
+		if c.Action != "" {
+			rlc.Action = relabel.Action(strings.ToLower(c.Action))
+		}
+
+		switch rlc.Action {
+		case relabel.Replace, relabel.Keep, relabel.Drop, relabel.LabelMap, relabel.LabelDrop, relabel.LabelKeep:
+		case relabel.HashMod:
+			if rlc.Modulus == 0 {
+				errs = append(errs, field.Required(p.Child("modulus"), "required for the hashmod action"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(p.Child("action"), c.Action, relabelActions))
 		}
 
 		if c.Regex != "" {
-			rlc.Regex = relabel.MustNewRegexp(c.Regex)
+			regex, err := newRegexp(p.Child("regex"), c.Regex)
+			if err != nil {
+				errs = append(errs, err)
+			}
+
+			rlc.Regex = regex
 		}
 
 		for _, l := range c.SourceLabels {
 			rlc.SourceLabels = append(rlc.SourceLabels, model.LabelName(l))
 		}
 
-		results = append(results, rlc)
+		results = append(results, &rlc)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return results, nil
+}
+
+// newRegexp compiles a regular expression from a ServiceMonitor for a relabel rule, reporting the field it came from
+// if it is invalid
+func newRegexp(path *field.Path, expr string) (relabel.Regexp, *field.Error) {
+	regex, err := relabel.NewRegexp(expr)
+	if err != nil {
+		return relabel.Regexp{}, field.Invalid(path, expr, err.Error())
 	}
 
-	return results
+	return regex, nil
 }
 
 func effectiveNamespaceSelector(sm *v1.ServiceMonitor) []string {
@@ -61,9 +140,10 @@ func effectiveNamespaceSelector(sm *v1.ServiceMonitor) []string {
 	return sm.Spec.NamespaceSelector.MatchNames
 }
 
-func sdConfig(namespaces []string) *kubernetes.SDConfig {
+func (w *writer) sdConfig(namespaces []string, labelSelector string) *kubernetes.SDConfig {
+	role := w.discoveryRole()
 	cfg := &kubernetes.SDConfig{
-		Role: kubernetes.RoleEndpoint,
+		Role: role,
 	}
 
 	if len(namespaces) != 0 {
@@ -72,8 +152,15 @@ func sdConfig(namespaces []string) *kubernetes.SDConfig {
 		}
 	}
 
-	// TODO: Global API Server config?
-	// TODO: TLS Config from global API Server config?
+	if labelSelector != "" {
+		// Endpoints and EndpointSlices inherit the labels of their service, so both can be filtered by the API server
+		cfg.Selectors = []kubernetes.SelectorConfig{
+			{Role: role, Label: labelSelector},
+			{Role: kubernetes.RoleService, Label: labelSelector},
+		}
+	}
+
+	w.apiServer.apply(cfg)
 	return cfg
 }
 
@@ -0,0 +1,72 @@
+//go:build ignore
+// +build ignore
+
+// This file is copied into prometheus-operator's pkg/prometheus package by hack/update-parity-goldens.sh so it can
+// call the unexported scrape config generator. It is not built as part of this module.
+
+package prometheus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blang/semver/v4"
+	"github.com/ghodss/yaml"
+	"github.com/go-kit/kit/log"
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus-operator/prometheus-operator/pkg/operator"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+func TestGenerateParityGoldens(t *testing.T) {
+	dir := os.Getenv("PARITY_FIXTURES")
+	if dir == "" {
+		t.Fatal("PARITY_FIXTURES is not set")
+	}
+
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cg := newConfigGenerator(log.NewNopLogger())
+	version := semver.MustParse(strings.TrimPrefix(operator.DefaultPrometheusVersion, "v"))
+
+	for _, fixture := range fixtures {
+		if strings.HasSuffix(fixture, ".golden.yaml") {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sm := &v1.ServiceMonitor{}
+		if err := yaml.Unmarshal(raw, sm); err != nil {
+			t.Fatalf("%s: %v", fixture, err)
+		}
+
+		var scrapeConfigs []yamlv2.MapSlice
+		for i, ep := range sm.Spec.Endpoints {
+			scrapeConfigs = append(scrapeConfigs, cg.generateServiceMonitorConfig(
+				version, sm, ep, i, nil, nil, nil, false, false, false, "", nil, nil, 1,
+			))
+		}
+
+		golden, err := yamlv2.Marshal(scrapeConfigs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := "# Generated by hack/update-parity-goldens.sh with prometheus-operator " + os.Getenv("PARITY_UPSTREAM_VERSION") +
+			" (Prometheus " + operator.DefaultPrometheusVersion + "). DO NOT EDIT.\n"
+		out := strings.TrimSuffix(fixture, ".yaml") + ".golden.yaml"
+		if err := ioutil.WriteFile(out, append([]byte(header), golden...), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
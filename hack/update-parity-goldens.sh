@@ -0,0 +1,28 @@
+#!/usr/bin/env bash
+# Regenerates config/testdata/parity/*.golden.yaml using prometheus-operator's own scrape config generator, at the
+# version of the monitoring API this module depends on. The generator is unexported, so it is driven from a test
+# copied into a scratch copy of the upstream module.
+set -euo pipefail
+
+root="$(cd "$(dirname "$0")/.." && pwd)"
+module="github.com/prometheus-operator/prometheus-operator"
+version="$(cd "${root}" && go list -m -f '{{.Version}}' "${module}/pkg/apis/monitoring")"
+
+work="$(mktemp -d)"
+trap 'chmod -R u+w "${work}"; rm -rf "${work}"' EXIT
+
+cd "${work}"
+src="$(GOFLAGS=-mod=mod go mod download -json "${module}@${version}" | sed -n 's/^[[:space:]]*"Dir": "\(.*\)",$/\1/p')"
+cp -r "${src}/." "${work}"
+chmod -R u+w "${work}"
+
+# The nested modules are not part of the upstream module zip
+go mod edit \
+  -replace "${module}/pkg/apis/monitoring=${module}/pkg/apis/monitoring@${version}" \
+  -replace "${module}/pkg/client=${module}/pkg/client@${version}"
+
+cp "${root}/hack/parity/generate_test.go" pkg/prometheus/zz_parity_generate_test.go
+sed -i.bak -e '/^\/\/go:build ignore$/d' -e '/^\/\/ +build ignore$/d' pkg/prometheus/zz_parity_generate_test.go
+
+PARITY_FIXTURES="${root}/config/testdata/parity" PARITY_UPSTREAM_VERSION="${version}" \
+  GOFLAGS=-mod=mod go test ./pkg/prometheus -run '^TestGenerateParityGoldens$' -count=1
@@ -0,0 +1,118 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for requests that are rejected because the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker opens after a number of consecutive failures and rejects requests until a cooldown has passed.
+// After the cooldown, requests are let through again; the first failure re-opens the breaker and the first
+// success closes it.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+
+	now func() time.Time
+}
+
+// NewCircuitBreaker creates a CircuitBreaker that opens for cooldown after threshold consecutive failures
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow returns true if a request may be attempted
+func (b *CircuitBreaker) Allow() bool {
+	return b.remaining() <= 0
+}
+
+// Success records a successful request, closing the breaker
+func (b *CircuitBreaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// Failure records a failed request, opening the breaker once the threshold is reached
+func (b *CircuitBreaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// Wait blocks until the breaker allows requests or ctx is done
+func (b *CircuitBreaker) Wait(ctx context.Context) error {
+	for {
+		d := b.remaining()
+		if d <= 0 {
+			return nil
+		}
+
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *CircuitBreaker) remaining() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.openUntil.IsZero() {
+		return 0
+	}
+
+	return b.openUntil.Sub(b.now())
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+// NewCircuitBreakerTransport wraps next so that requests fail fast with ErrCircuitOpen while breaker is open.
+// Connection errors and 5xx responses without an API error payload count as failures. A 5xx with an error payload
+// also counts as a failure for write requests, since the application failing to apply a write usually means its
+// storage is broken.
+func NewCircuitBreakerTransport(next http.RoundTripper, breaker *CircuitBreaker) http.RoundTripper {
+	return &breakerTransport{next: next, breaker: breaker}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if (err != nil && req.Context().Err() == nil) || IsUnavailable(resp) || (isWrite(req) && IsServerError(resp)) {
+		t.breaker.Failure()
+	} else if err == nil {
+		t.breaker.Success()
+	}
+
+	return resp, err
+}
+
+func isWrite(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	default:
+		return true
+	}
+}
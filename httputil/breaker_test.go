@@ -0,0 +1,98 @@
+package httputil
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	sut := NewCircuitBreaker(2, time.Minute)
+	sut.now = func() time.Time { return now }
+
+	assert.True(t, sut.Allow())
+
+	sut.Failure()
+	assert.True(t, sut.Allow(), "breaker opened before reaching the threshold")
+
+	sut.Failure()
+	assert.False(t, sut.Allow(), "breaker did not open at the threshold")
+
+	now = now.Add(time.Minute)
+	assert.True(t, sut.Allow(), "breaker did not allow a request after the cooldown")
+
+	sut.Failure()
+	assert.False(t, sut.Allow(), "breaker did not re-open after a failure once the cooldown passed")
+
+	now = now.Add(time.Minute)
+	sut.Success()
+	sut.Failure()
+	assert.True(t, sut.Allow(), "breaker did not reset after a success")
+}
+
+func TestCircuitBreakerWait(t *testing.T) {
+	sut := NewCircuitBreaker(1, time.Hour)
+	require.NoError(t, sut.Wait(context.Background()))
+
+	sut.Failure()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, sut.Wait(ctx))
+}
+
+func TestCircuitBreakerTransport(t *testing.T) {
+	_, next := respondWith(502, 0, 200)
+	breaker := NewCircuitBreaker(2, time.Hour)
+	sut := NewCircuitBreakerTransport(next, breaker)
+
+	req, err := http.NewRequest(http.MethodGet, "http://agent/", nil)
+	require.NoError(t, err)
+
+	resp, err := sut.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 502, resp.StatusCode)
+
+	_, err = sut.RoundTrip(req)
+	require.Error(t, err)
+	assert.NotEqual(t, ErrCircuitOpen, err)
+
+	_, err = sut.RoundTrip(req)
+	require.Equal(t, ErrCircuitOpen, err)
+}
+
+func TestCircuitBreakerTransportErrorPayload(t *testing.T) {
+	for _, tt := range []struct {
+		method string
+		opens  bool
+	}{
+		{method: http.MethodGet, opens: false},
+		{method: http.MethodPut, opens: true},
+		{method: http.MethodDelete, opens: true},
+	} {
+		t.Run(tt.method, func(t *testing.T) {
+			_, next := respondWith(rejected, 200)
+			breaker := NewCircuitBreaker(1, time.Hour)
+			sut := NewCircuitBreakerTransport(next, breaker)
+
+			req, err := http.NewRequest(tt.method, "http://agent/", nil)
+			require.NoError(t, err)
+
+			resp, err := sut.RoundTrip(req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), "invalid config", "the error payload was not preserved")
+
+			assert.Equal(t, !tt.opens, breaker.Allow(), "unexpected breaker state after an error payload")
+		})
+	}
+}
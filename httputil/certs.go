@@ -0,0 +1,104 @@
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertReloader serves a TLS certificate from files that are replaced when the certificate is rotated, like the
+// files of a mounted Secret managed by cert-manager
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+
+	log logrus.FieldLogger
+}
+
+// NewCertReloader loads the certificate and key from the specified files, returning an error if they cannot be
+// loaded
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      logrus.WithField("prefix", "certs").WithField("cert", certFile),
+	}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload loads the certificate and key again if either file changed, returning true if the certificate was
+// replaced. The current certificate is kept if the new one cannot be loaded, for example because only one of the
+// files has been replaced so far.
+func (r *CertReloader) Reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read certificate: %w", err)
+	}
+
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	r.lock.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	r.lock.Lock()
+	r.cert, r.certPEM, r.keyPEM = &cert, certPEM, keyPEM
+	r.lock.Unlock()
+
+	return true, nil
+}
+
+// Run reloads the certificate every interval until ctx is done
+func (r *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if reloaded, err := r.Reload(); err != nil {
+			r.log.WithError(err).Warn("Failed to reload certificate, continuing to serve the previous one")
+		} else if reloaded {
+			r.log.Info("Reloaded certificate")
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.cert, nil
+}
@@ -0,0 +1,155 @@
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how often and how quickly a RetryTransport retries failed requests
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is retried after the first attempt, 0 disables retries
+	MaxRetries int
+
+	// MinBackoff is the delay before the first retry. It doubles with each retry up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// backoff returns the delay before the given retry, with jitter so that concurrent clients do not retry in lockstep
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 0; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	// Wait between half and all of the backoff
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetryTransport wraps next so that idempotent requests are retried according to policy when they fail with a
+// connection error or a 5xx status code without an API error payload
+func NewRetryTransport(next http.RoundTripper, policy RetryPolicy) http.RoundTripper {
+	return &retryTransport{next: next, policy: policy, sleep: sleep}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	for retry := 0; ; retry++ {
+		if retry > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if retry >= t.policy.MaxRetries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		// Discard the failed response so the connection can be reused
+		_, _, dispose := MakeDisposer(resp, err)
+		dispose()
+
+		if err := t.sleep(req.Context(), t.policy.backoff(retry)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	default:
+		return false
+	}
+}
+
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Don't retry if the caller gave up
+		return req.Context().Err() == nil && !errors.Is(err, ErrCircuitOpen)
+	}
+
+	return IsUnavailable(resp)
+}
+
+// IsServerError returns true if resp has a 5xx status code
+func IsServerError(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode >= http.StatusInternalServerError
+}
+
+// maxErrorPayloadSize limits how much of a response body is buffered to look for an API error payload
+const maxErrorPayloadSize = 64 * 1024
+
+// HasErrorPayload returns true if the body of resp is an API error payload like `{"status":"error","data":{...}}`,
+// as written by the agent and Prometheus APIs. The body is buffered so it can still be read afterwards.
+func HasErrorPayload(resp *http.Response) bool {
+	if resp == nil || resp.Body == nil {
+		return false
+	}
+
+	peeked, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorPayloadSize))
+	resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(peeked), resp.Body), Closer: resp.Body}
+	if err != nil {
+		return false
+	}
+
+	payload := struct {
+		Status string `json:"status"`
+	}{}
+
+	return json.Unmarshal(peeked, &payload) == nil && payload.Status == "error"
+}
+
+// IsUnavailable returns true if resp is a 5xx that did not come from the application behind the server, like a
+// crash or a proxy that could not reach it. A 5xx with an API error payload is the application's final answer to
+// the request, for example the agent rejecting a config, so it is neither retried nor a sign the server is down.
+func IsUnavailable(resp *http.Response) bool {
+	return IsServerError(resp) && !HasErrorPayload(resp)
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+package httputil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// rejected responds with a 500 carrying an API error payload, like the agent rejecting a config
+const rejected = -1
+
+func respondWith(codes ...int) (*[]string, roundTripFunc) {
+	var bodies []string
+
+	return &bodies, func(req *http.Request) (*http.Response, error) {
+		body := ""
+		if req.Body != nil {
+			raw, _ := ioutil.ReadAll(req.Body)
+			body = string(raw)
+		}
+		bodies = append(bodies, body)
+
+		code := codes[0]
+		if len(codes) > 1 {
+			codes = codes[1:]
+		}
+
+		if code == 0 {
+			return nil, fmt.Errorf("connection refused")
+		} else if code == rejected {
+			return &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"status":"error","data":{"error":"invalid config"}}`)),
+			}, nil
+		}
+
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	makeSut := func(next http.RoundTripper) (*[]time.Duration, *retryTransport) {
+		var sleeps []time.Duration
+		sut := NewRetryTransport(next, policy).(*retryTransport)
+		sut.sleep = func(_ context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		}
+
+		return &sleeps, sut
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		codes    []int
+		attempts int
+		code     int
+		err      bool
+	}{
+		{name: "Success", method: http.MethodGet, codes: []int{200}, attempts: 1, code: 200},
+		{name: "Client Error", method: http.MethodGet, codes: []int{400}, attempts: 1, code: 400},
+		{name: "Recovers", method: http.MethodPut, codes: []int{502, 0, 200}, attempts: 3, code: 200},
+		{name: "Gives Up", method: http.MethodDelete, codes: []int{503}, attempts: 4, code: 503},
+		{name: "Connection Error", method: http.MethodGet, codes: []int{0}, attempts: 4, err: true},
+		{name: "Error Payload", method: http.MethodPut, codes: []int{rejected, 200}, attempts: 1, code: 500},
+		{name: "Not Idempotent", method: http.MethodPost, codes: []int{502, 200}, attempts: 1, code: 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies, next := respondWith(tt.codes...)
+			sleeps, sut := makeSut(next)
+
+			req, err := http.NewRequest(tt.method, "http://agent/", strings.NewReader("body"))
+			require.NoError(t, err)
+
+			resp, err := sut.RoundTrip(req)
+			if tt.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.code, resp.StatusCode)
+			}
+
+			require.Len(t, *bodies, tt.attempts)
+			for _, body := range *bodies {
+				assert.Equal(t, "body", body, "the body must be replayed on each attempt")
+			}
+
+			assert.Len(t, *sleeps, tt.attempts-1)
+		})
+	}
+
+	t.Run("Cancelled", func(t *testing.T) {
+		_, next := respondWith(502)
+		sut := NewRetryTransport(next, policy)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://agent/", nil)
+		require.NoError(t, err)
+
+		_, err = sut.RoundTrip(req)
+		require.Equal(t, context.Canceled, err)
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := policy.backoff(retry)
+
+		assert.GreaterOrEqual(t, int64(d), int64(max/2), "retry %d", retry)
+		assert.LessOrEqual(t, int64(d), int64(max), "retry %d", retry)
+	}
+
+	assert.Equal(t, time.Duration(0), RetryPolicy{}.backoff(3))
+}
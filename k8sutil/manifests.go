@@ -0,0 +1,141 @@
+package k8sutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var manifestExtensions = map[string]struct{}{
+	".yaml": {},
+	".yml":  {},
+	".json": {},
+}
+
+// ReadServiceMonitors reads all ServiceMonitors from the specified files. Directories are searched recursively
+// for YAML and JSON manifests, and "-" reads from stdin. Other kinds of objects in the manifests are ignored.
+func ReadServiceMonitors(paths ...string) ([]*monitoringv1.ServiceMonitor, error) {
+	var results []*monitoringv1.ServiceMonitor
+
+	for _, p := range paths {
+		if p == "-" {
+			sms, err := DecodeServiceMonitors(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf("stdin: %w", err)
+			}
+
+			results = append(results, sms...)
+			continue
+		}
+
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			// Always read files that were explicitly specified, only filter files found in directories
+			if _, ok := manifestExtensions[strings.ToLower(filepath.Ext(path))]; path != p && !ok {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			sms, err := DecodeServiceMonitors(f)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			results = append(results, sms...)
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// DecodeServiceMonitors decodes all ServiceMonitors from a stream of YAML documents or JSON objects, including
+// ServiceMonitors in lists like the ones produced by kubectl get -o yaml.
+func DecodeServiceMonitors(r io.Reader) ([]*monitoringv1.ServiceMonitor, error) {
+	var results []*monitoringv1.ServiceMonitor
+
+	d := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		sms, err := decodeServiceMonitorObject(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, sms...)
+	}
+}
+
+func decodeServiceMonitorObject(raw json.RawMessage) ([]*monitoringv1.ServiceMonitor, error) {
+	if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+
+	switch meta.Kind {
+	case monitoringv1.ServiceMonitorsKind:
+		sm := &monitoringv1.ServiceMonitor{}
+		if err := json.Unmarshal(raw, sm); err != nil {
+			return nil, fmt.Errorf("invalid ServiceMonitor: %w", err)
+		}
+
+		return []*monitoringv1.ServiceMonitor{sm}, nil
+	case "List", monitoringv1.ServiceMonitorsKind + "List":
+		var list struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", meta.Kind, err)
+		}
+
+		var results []*monitoringv1.ServiceMonitor
+		for _, item := range list.Items {
+			sms, err := decodeServiceMonitorObject(item)
+			if err != nil {
+				return nil, err
+			}
+
+			results = append(results, sms...)
+		}
+
+		return results, nil
+	}
+
+	return nil, nil
+}
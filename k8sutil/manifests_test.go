@@ -0,0 +1,92 @@
+package k8sutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifests = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: ignored
+---
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: a
+  namespace: myapp
+spec:
+  endpoints:
+  - port: metrics
+---
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: monitoring.coreos.com/v1
+  kind: ServiceMonitor
+  metadata:
+    name: b
+  spec:
+    endpoints:
+    - port: http
+    - port: grpc
+`
+
+func TestDecodeServiceMonitors(t *testing.T) {
+	t.Run("YAML", func(t *testing.T) {
+		sms, err := DecodeServiceMonitors(strings.NewReader(testManifests))
+		require.NoError(t, err)
+
+		require.Len(t, sms, 2)
+		assert.Equal(t, "a", sms[0].Name)
+		assert.Equal(t, "myapp", sms[0].Namespace)
+		assert.Len(t, sms[0].Spec.Endpoints, 1)
+		assert.Equal(t, "b", sms[1].Name)
+		assert.Len(t, sms[1].Spec.Endpoints, 2)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		sms, err := DecodeServiceMonitors(strings.NewReader(`{"kind": "ServiceMonitor", "metadata": {"name": "a"}}`))
+		require.NoError(t, err)
+
+		require.Len(t, sms, 1)
+		assert.Equal(t, "a", sms[0].Name)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := DecodeServiceMonitors(strings.NewReader(`{"kind": "ServiceMonitor", "spec": {"endpoints": "a"}}`))
+		require.Error(t, err)
+	})
+}
+
+func TestReadServiceMonitors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte(testManifests), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a manifest"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "c.txt"), []byte("kind: ServiceMonitor\nmetadata:\n  name: c\n"), 0600))
+
+	t.Run("Directory", func(t *testing.T) {
+		sms, err := ReadServiceMonitors(dir)
+		require.NoError(t, err)
+		assert.Len(t, sms, 2)
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		sms, err := ReadServiceMonitors(filepath.Join(dir, "a.yaml"), filepath.Join(dir, "c.txt"))
+		require.NoError(t, err)
+		require.Len(t, sms, 3)
+		assert.Equal(t, "c", sms[2].Name)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := ReadServiceMonitors(filepath.Join(dir, "missing.yaml"))
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,266 @@
+package operator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// configFileManager manages the instance configs in an agent config file instead of the scraping service API, for
+// agents that run as a DaemonSet and load their instance configs from a shared file or ConfigMap
+type configFileManager struct {
+	store ConfigStore
+
+	log logrus.Ext1FieldLogger
+}
+
+// NewConfigFileManager manages the instance configs under prometheus.configs in the agent config file held by
+// store. The rest of the file is preserved, so it can be seeded with the settings the agents need.
+func NewConfigFileManager(store ConfigStore) *configFileManager {
+	return &configFileManager{
+		store: store,
+		log:   logrus.WithField("prefix", "configManager").WithField("store", store.String()),
+	}
+}
+
+func (f *configFileManager) read() (*agentConfigFile, error) {
+	raw, err := f.store.Read()
+	if err != nil {
+		return nil, withKind(ErrAgentUnavailable, err)
+	}
+
+	file, err := parseAgentConfigFile(raw)
+	if err != nil {
+		return nil, withKind(ErrAgentUnavailable, err)
+	}
+
+	return file, nil
+}
+
+func (f *configFileManager) update(fn func(file *agentConfigFile) error) error {
+	err := f.store.Update(func(current []byte) ([]byte, error) {
+		file, err := parseAgentConfigFile(current)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := fn(file); err != nil {
+			return nil, err
+		}
+
+		return file.marshal()
+	})
+
+	// Errors from fn are already classified, anything else is a problem with the store or the file in it. A full
+	// ConfigMap only frees up when configs are removed, so retrying the update will not succeed.
+	var kindErr *configManagerError
+	if errors.Is(err, ErrConfigMapTooLarge) {
+		err = withKind(ErrInvalidConfig, err)
+	} else if err != nil && !errors.As(err, &kindErr) {
+		err = withKind(ErrAgentUnavailable, err)
+	}
+
+	return err
+}
+
+func (f *configFileManager) ListScrapeConfigs() ([]string, error) {
+	file, err := f.read()
+	if err != nil {
+		return nil, fmt.Errorf("ListScrapeConfigs: %w", err)
+	}
+
+	return file.names(), nil
+}
+
+func (f *configFileManager) GetScrapeConfig(name string) (*instance.Config, error) {
+	file, err := f.read()
+	if err != nil {
+		return nil, fmt.Errorf("GetScrapeConfig: %w", err)
+	}
+
+	cfg, err := file.get(name)
+	if err != nil {
+		return nil, fmt.Errorf("GetScrapeConfig: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (f *configFileManager) UpdateScrapeConfig(cfg *instance.Config) error {
+	// Agents loading the file refuse to start if any instance config is invalid, so check it before writing it
+	if _, err := config.Normalize(cfg); err != nil {
+		return fmt.Errorf("UpdateScrapeConfig: %w", withKind(ErrInvalidConfig, err))
+	}
+
+	if err := f.update(func(file *agentConfigFile) error {
+		return file.put(cfg)
+	}); err != nil {
+		return fmt.Errorf("UpdateScrapeConfig: %w", err)
+	}
+
+	f.log.WithField("config", cfg.Name).Info("Config Updated")
+	return nil
+}
+
+func (f *configFileManager) DeleteScrapeConfig(cfg *instance.Config) error {
+	if err := f.update(func(file *agentConfigFile) error {
+		return file.remove(cfg.Name)
+	}); err != nil {
+		return fmt.Errorf("DeleteScrapeConfig: %w", err)
+	}
+
+	f.log.WithField("config", cfg.Name).Info("Config Deleted")
+	return nil
+}
+
+// agentConfigFile is a parsed agent config file. Keys are kept in order so the parts of the file that are not
+// managed by the operator are preserved as written.
+type agentConfigFile struct {
+	doc     yaml.MapSlice
+	configs []yaml.MapSlice
+}
+
+func parseAgentConfigFile(raw []byte) (*agentConfigFile, error) {
+	result := &agentConfigFile{}
+	if err := yaml.Unmarshal(raw, &result.doc); err != nil {
+		return nil, fmt.Errorf("parse agent config file: %w", err)
+	}
+
+	prometheus, ok := mapSliceGet(result.doc, "prometheus").(yaml.MapSlice)
+	if !ok && mapSliceGet(result.doc, "prometheus") != nil {
+		return nil, fmt.Errorf("parse agent config file: prometheus must be a map")
+	}
+
+	configs, ok := mapSliceGet(prometheus, "configs").([]interface{})
+	if !ok && mapSliceGet(prometheus, "configs") != nil {
+		return nil, fmt.Errorf("parse agent config file: prometheus.configs must be a list")
+	}
+
+	for i, c := range configs {
+		cfg, ok := c.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("parse agent config file: prometheus.configs[%d] must be a map", i)
+		}
+
+		result.configs = append(result.configs, cfg)
+	}
+
+	return result, nil
+}
+
+func (a *agentConfigFile) names() []string {
+	names := make([]string, 0, len(a.configs))
+	for _, c := range a.configs {
+		names = append(names, fmt.Sprint(mapSliceGet(c, "name")))
+	}
+
+	return names
+}
+
+func (a *agentConfigFile) index(name string) int {
+	for i, c := range a.configs {
+		if fmt.Sprint(mapSliceGet(c, "name")) == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (a *agentConfigFile) get(name string) (*instance.Config, error) {
+	i := a.index(name)
+	if i < 0 {
+		return nil, withKind(ErrConfigNotFound, fmt.Errorf("config %s does not exist", name))
+	}
+
+	raw, err := yaml.Marshal(a.configs[i])
+	if err != nil {
+		return nil, err
+	}
+
+	return instance.UnmarshalConfig(bytes.NewReader(raw))
+}
+
+func (a *agentConfigFile) put(cfg *instance.Config) error {
+	raw, err := instance.MarshalConfig(cfg, false)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	var item yaml.MapSlice
+	if err := yaml.Unmarshal(raw, &item); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if i := a.index(cfg.Name); i >= 0 {
+		a.configs[i] = item
+	} else {
+		a.configs = append(a.configs, item)
+	}
+
+	// Keep the file stable regardless of the order configs are synced in
+	sort.SliceStable(a.configs, func(i, j int) bool {
+		return fmt.Sprint(mapSliceGet(a.configs[i], "name")) < fmt.Sprint(mapSliceGet(a.configs[j], "name"))
+	})
+
+	return nil
+}
+
+func (a *agentConfigFile) remove(name string) error {
+	i := a.index(name)
+	if i < 0 {
+		return withKind(ErrConfigNotFound, fmt.Errorf("config %s does not exist", name))
+	}
+
+	a.configs = append(a.configs[:i], a.configs[i+1:]...)
+	return nil
+}
+
+func (a *agentConfigFile) marshal() ([]byte, error) {
+	configs := a.configs
+	if configs == nil {
+		configs = []yaml.MapSlice{}
+	}
+
+	prometheus, _ := mapSliceGet(a.doc, "prometheus").(yaml.MapSlice)
+	doc := mapSliceSet(a.doc, "prometheus", mapSliceSet(prometheus, "configs", configs))
+
+	return yaml.Marshal(doc)
+}
+
+// mapSliceGet returns the value of key in m, or nil if it is not set
+func mapSliceGet(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+
+	return nil
+}
+
+// mapSliceSet returns a copy of m with key set to value, keeping the position of key if it is already set
+func mapSliceSet(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	result := make(yaml.MapSlice, 0, len(m)+1)
+	found := false
+	for _, item := range m {
+		if item.Key == key {
+			item.Value = value
+			found = true
+		}
+
+		result = append(result, item)
+	}
+
+	if !found {
+		result = append(result, yaml.MapItem{Key: key, Value: value})
+	}
+
+	return result
+}
@@ -0,0 +1,249 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const seedAgentConfig = `server:
+  http_listen_port: 12345
+prometheus:
+  wal_directory: /var/lib/agent
+  global:
+    scrape_interval: 1m
+`
+
+func testInstanceConfigs(t *testing.T) []*instance.Config {
+	configs, _, err := testWriter().ScrapeConfigsForServiceMonitor(&monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Port: "a"}, {Port: "b"}},
+		},
+	})
+	require.NoError(t, err)
+
+	return configs
+}
+
+func testConfigFileManager(t *testing.T, store ConfigStore) {
+	configs := testInstanceConfigs(t)
+	sut := NewConfigFileManager(store)
+
+	// Write them out of order to make sure the file is kept sorted
+	require.NoError(t, sut.UpdateScrapeConfig(configs[1]))
+	require.NoError(t, sut.UpdateScrapeConfig(configs[0]))
+
+	names, err := sut.ListScrapeConfigs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"myapp/dummy/0", "myapp/dummy/1"}, names)
+
+	live, err := sut.GetScrapeConfig("myapp/dummy/0")
+	require.NoError(t, err)
+	assert.Equal(t, "myapp/dummy/0", live.Name)
+	require.Len(t, live.ScrapeConfigs, 1)
+	assert.Equal(t, configs[0].ScrapeConfigs[0].JobName, live.ScrapeConfigs[0].JobName)
+
+	// Updating an existing config replaces it
+	configs[0].ScrapeConfigs[0].JobName = "renamed"
+	require.NoError(t, sut.UpdateScrapeConfig(configs[0]))
+	live, err = sut.GetScrapeConfig("myapp/dummy/0")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", live.ScrapeConfigs[0].JobName)
+
+	require.NoError(t, sut.DeleteScrapeConfig(configs[1]))
+	names, err = sut.ListScrapeConfigs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"myapp/dummy/0"}, names)
+
+	_, err = sut.GetScrapeConfig("myapp/dummy/1")
+	assert.True(t, errors.Is(err, ErrConfigNotFound), "unexpected error: %v", err)
+	err = sut.DeleteScrapeConfig(configs[1])
+	assert.True(t, errors.Is(err, ErrConfigNotFound), "unexpected error: %v", err)
+
+	invalid := *configs[1]
+	invalid.ScrapeConfigs = append([]*config.ScrapeConfig{}, configs[0].ScrapeConfigs[0], configs[0].ScrapeConfigs[0])
+	err = sut.UpdateScrapeConfig(&invalid)
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "unexpected error: %v", err)
+
+	// The settings the operator does not manage are preserved
+	raw, err := store.Read()
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "http_listen_port: 12345")
+	assert.Contains(t, string(raw), "wal_directory: /var/lib/agent")
+	assert.Contains(t, string(raw), "scrape_interval: 1m")
+}
+
+func TestConfigFileManager(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	t.Run("File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "agent-config")
+		require.NoError(t, err)
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		path := filepath.Join(dir, "agent.yaml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(seedAgentConfig), 0644))
+
+		testConfigFileManager(t, NewFileConfigStore(path))
+
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 1, "temporary files were not cleaned up")
+	})
+
+	t.Run("File Unchanged", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "agent-config")
+		require.NoError(t, err)
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		path := filepath.Join(dir, "agent.yaml")
+		sut := NewConfigFileManager(NewFileConfigStore(path))
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+
+		before, err := os.Stat(path)
+		require.NoError(t, err)
+
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+
+		after, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(before, after), "the file was replaced without changes")
+	})
+
+	t.Run("File Does Not Exist", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "agent-config")
+		require.NoError(t, err)
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		sut := NewConfigFileManager(NewFileConfigStore(filepath.Join(dir, "agent.yaml")))
+		names, err := sut.ListScrapeConfigs()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+		names, err = sut.ListScrapeConfigs()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"myapp/dummy/0"}, names)
+	})
+
+	t.Run("Corrupt File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "agent-config")
+		require.NoError(t, err)
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		path := filepath.Join(dir, "agent.yaml")
+		require.NoError(t, ioutil.WriteFile(path, []byte("prometheus: [oops"), 0644))
+
+		sut := NewConfigFileManager(NewFileConfigStore(path))
+		_, err = sut.ListScrapeConfigs()
+		assert.True(t, errors.Is(err, ErrAgentUnavailable), "unexpected error: %v", err)
+
+		err = sut.UpdateScrapeConfig(testInstanceConfigs(t)[0])
+		assert.True(t, errors.Is(err, ErrAgentUnavailable), "unexpected error: %v", err)
+	})
+
+	t.Run("ConfigMap", func(t *testing.T) {
+		client := k8sfake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "grafana-agent"},
+			Data:       map[string]string{"agent.yaml": seedAgentConfig, "other": "untouched"},
+		})
+
+		testConfigFileManager(t, NewConfigMapConfigStore(client, "monitoring", "grafana-agent", "agent.yaml"))
+
+		cm, err := client.CoreV1().ConfigMaps("monitoring").Get(context.Background(), "grafana-agent", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "untouched", cm.Data["other"])
+	})
+
+	t.Run("ConfigMap Does Not Exist", func(t *testing.T) {
+		client := k8sfake.NewSimpleClientset()
+		sut := NewConfigFileManager(NewConfigMapConfigStore(client, "monitoring", "grafana-agent", "agent.yaml"))
+
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+
+		cm, err := client.CoreV1().ConfigMaps("monitoring").Get(context.Background(), "grafana-agent", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Contains(t, cm.Data["agent.yaml"], "name: myapp/dummy/0")
+	})
+
+	t.Run("ConfigMap Unchanged", func(t *testing.T) {
+		client := k8sfake.NewSimpleClientset()
+		sut := NewConfigFileManager(NewConfigMapConfigStore(client, "monitoring", "grafana-agent", "agent.yaml"))
+
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+		client.ClearActions()
+
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+		for _, action := range client.Actions() {
+			assert.Equal(t, "get", action.GetVerb(), "the ConfigMap was written without changes")
+		}
+	})
+
+	t.Run("ConfigMap Too Large", func(t *testing.T) {
+		client := k8sfake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "grafana-agent"},
+			Data:       map[string]string{"agent.yaml": seedAgentConfig, "other": strings.Repeat("x", maxConfigMapSize-len(seedAgentConfig))},
+		})
+
+		sut := NewConfigFileManager(NewConfigMapConfigStore(client, "monitoring", "grafana-agent", "agent.yaml"))
+		err := sut.UpdateScrapeConfig(testInstanceConfigs(t)[0])
+		assert.True(t, errors.Is(err, ErrConfigMapTooLarge), "unexpected error: %v", err)
+		assert.True(t, errors.Is(err, ErrInvalidConfig), "unexpected error: %v", err)
+
+		cm, err := client.CoreV1().ConfigMaps("monitoring").Get(context.Background(), "grafana-agent", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, seedAgentConfig, cm.Data["agent.yaml"])
+	})
+
+	t.Run("ConfigMap Conflict", func(t *testing.T) {
+		client := k8sfake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "grafana-agent"},
+			Data:       map[string]string{"agent.yaml": seedAgentConfig},
+		})
+
+		conflicts := 0
+		client.PrependReactor("update", "configmaps", func(_ k8stesting.Action) (bool, runtime.Object, error) {
+			if conflicts < 2 {
+				conflicts++
+				return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "grafana-agent", errors.New("dummy"))
+			}
+
+			return false, nil, nil
+		})
+
+		sut := NewConfigFileManager(NewConfigMapConfigStore(client, "monitoring", "grafana-agent", "agent.yaml"))
+		require.NoError(t, sut.UpdateScrapeConfig(testInstanceConfigs(t)[0]))
+		assert.Equal(t, 2, conflicts)
+
+		names, err := sut.ListScrapeConfigs()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"myapp/dummy/0"}, names)
+	})
+}
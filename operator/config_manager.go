@@ -2,11 +2,16 @@ package operator
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/grafana/agent/pkg/prom/instance"
 	"github.com/hashicorp/go-cleanhttp"
@@ -16,25 +21,73 @@ import (
 
 type ConfigManager interface {
 	ListScrapeConfigs() ([]string, error)
+	GetScrapeConfig(name string) (*instance.Config, error)
 
 	UpdateScrapeConfig(cfg *instance.Config) error
 	DeleteScrapeConfig(cfg *instance.Config) error
 }
 
+// availabilityWaiter is implemented by ConfigManagers that know when the agent is unavailable
+type availabilityWaiter interface {
+	// WaitUntilAvailable blocks while the agent is known to be unavailable or until ctx is done
+	WaitUntilAvailable(ctx context.Context) error
+}
+
 type grafanaAgentConfigManager struct {
 	apiRoot string
 	c       *http.Client
 
+	retries httputil.RetryPolicy
+	breaker *httputil.CircuitBreaker
+
 	log logrus.Ext1FieldLogger
 }
 
-func NewGrafanaAgentConfigManager(apiRoot string) *grafanaAgentConfigManager {
-	return &grafanaAgentConfigManager{
+type ConfigManagerOption func(g *grafanaAgentConfigManager)
+
+// WithRetryPolicy retries idempotent requests that fail with a connection error or a 5xx status code. A 5xx with an
+// error payload is the agent's answer to the request, like a rejected config, and is not retried.
+func WithRetryPolicy(p httputil.RetryPolicy) ConfigManagerOption {
+	return func(g *grafanaAgentConfigManager) {
+		g.retries = p
+	}
+}
+
+// WithCircuitBreaker fails requests fast while b is open. Retries of a request only count as a single failure. Reads
+// that fail with an agent error payload do not count as failures, but updates and deletes do, since the agent
+// fails to store configs that way when its KV store is broken.
+func WithCircuitBreaker(b *httputil.CircuitBreaker) ConfigManagerOption {
+	return func(g *grafanaAgentConfigManager) {
+		g.breaker = b
+	}
+}
+
+func NewGrafanaAgentConfigManager(apiRoot string, opts ...ConfigManagerOption) *grafanaAgentConfigManager {
+	result := &grafanaAgentConfigManager{
 		apiRoot: strings.TrimSuffix(apiRoot, "/"),
 		c:       cleanhttp.DefaultPooledClient(),
 
 		log: logrus.WithField("prefix", "configManager"),
 	}
+
+	for _, opt := range opts {
+		opt(result)
+	}
+
+	result.c.Transport = httputil.NewRetryTransport(result.c.Transport, result.retries)
+	if result.breaker != nil {
+		result.c.Transport = httputil.NewCircuitBreakerTransport(result.c.Transport, result.breaker)
+	}
+
+	return result
+}
+
+func (g *grafanaAgentConfigManager) WaitUntilAvailable(ctx context.Context) error {
+	if g.breaker == nil {
+		return nil
+	}
+
+	return g.breaker.Wait(ctx)
 }
 
 func (g *grafanaAgentConfigManager) route(cfg *instance.Config) string {
@@ -59,11 +112,11 @@ func (g *grafanaAgentConfigManager) ListScrapeConfigs() ([]string, error) {
 	defer dispose()
 
 	if err != nil {
-		return nil, fmt.Errorf("ListScrapeConfigs: failed to list: %w", err)
+		return nil, fmt.Errorf("ListScrapeConfigs: failed to list: %w", withKind(ErrAgentUnavailable, err))
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("ListScrapeConfigs: unexpected status code: %s", resp.Status)
+		return nil, fmt.Errorf("ListScrapeConfigs: %w", unexpectedStatus(resp))
 	}
 
 	payload := listResponse{}
@@ -74,6 +127,48 @@ func (g *grafanaAgentConfigManager) ListScrapeConfigs() ([]string, error) {
 	return payload.Data.Configs, nil
 }
 
+func (g *grafanaAgentConfigManager) GetScrapeConfig(name string) (*instance.Config, error) {
+	type getResponse struct {
+		Status string `json:"status"`
+		Data   struct {
+			Value string `json:"value"`
+		} `json:"data"`
+	}
+
+	route := fmt.Sprintf("%s/agent/api/v1/configs/%s", g.apiRoot, url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodGet, route, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GetScrapeConfig: make request: %w", err)
+	}
+
+	g.log.WithField("config", name).Debug("Fetching ScrapeConfig")
+	resp, err, dispose := httputil.MakeDisposer(g.c.Do(req))
+	defer dispose()
+
+	if err != nil {
+		return nil, fmt.Errorf("GetScrapeConfig: failed to fetch: %w", withKind(ErrAgentUnavailable, err))
+	}
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		// Depending on the version, the agent responds with either status code if the config does not exist
+		return nil, fmt.Errorf("GetScrapeConfig: %w", withKind(ErrConfigNotFound, describeStatus(resp)))
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GetScrapeConfig: %w", unexpectedStatus(resp))
+	}
+
+	payload := getResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("GetScrapeConfig: unmarshal response: %w", err)
+	}
+
+	cfg, err := instance.UnmarshalConfig(strings.NewReader(payload.Data.Value))
+	if err != nil {
+		return nil, fmt.Errorf("GetScrapeConfig: unmarshal config: %w", err)
+	}
+
+	return cfg, nil
+}
+
 func (g *grafanaAgentConfigManager) UpdateScrapeConfig(cfg *instance.Config) error {
 	log := g.log.WithField("config", cfg.Name)
 
@@ -83,7 +178,7 @@ func (g *grafanaAgentConfigManager) UpdateScrapeConfig(cfg *instance.Config) err
 	}
 
 	route := g.route(cfg)
-	req, err := http.NewRequest(http.MethodPost, route, bytes.NewReader(raw))
+	req, err := http.NewRequest(http.MethodPut, route, bytes.NewReader(raw))
 	if err != nil {
 		return fmt.Errorf("UpdateScrapeConfig: make request: %w", err)
 	}
@@ -93,16 +188,25 @@ func (g *grafanaAgentConfigManager) UpdateScrapeConfig(cfg *instance.Config) err
 	defer dispose()
 
 	if err != nil {
-		return fmt.Errorf("UpdateScrapeConfig: failed to sync: %w", err)
+		return fmt.Errorf("UpdateScrapeConfig: failed to sync: %w", withKind(ErrAgentUnavailable, err))
 	}
 
 	if resp.StatusCode == http.StatusOK {
 		log.Info("Config Updated")
 	} else if resp.StatusCode == http.StatusCreated {
 		log.Info("Config Added")
+	} else if httputil.IsServerError(resp) && httputil.HasErrorPayload(resp) {
+		// The agent responds with a 500 both if it fails to load the config and if it fails to store it, so only
+		// errors from loading the config mean retrying cannot succeed
+		msg := errorMessage(resp)
+		kind := ErrAgentUnavailable
+		if isAgentValidationError(msg) {
+			kind = ErrInvalidConfig
+		}
+
+		return fmt.Errorf("UpdateScrapeConfig: %w", withKind(kind, statusError(resp, msg)))
 	} else {
-		// TODO: Also dump the body on error?
-		return fmt.Errorf("UpdateScrapeConfig: unexpected status code: %s", resp.Status)
+		return fmt.Errorf("UpdateScrapeConfig: %w", unexpectedStatus(resp))
 	}
 
 	return nil
@@ -121,21 +225,107 @@ func (g *grafanaAgentConfigManager) DeleteScrapeConfig(cfg *instance.Config) err
 	defer dispose()
 
 	if err != nil {
-		return fmt.Errorf("DeleteScrapeConfig: failed to sync: %w", err)
+		return fmt.Errorf("DeleteScrapeConfig: failed to sync: %w", withKind(ErrAgentUnavailable, err))
 	}
 
 	if resp.StatusCode == http.StatusOK {
 		log.Info("Config Deleted")
-	} else if resp.StatusCode == http.StatusBadRequest {
-		// TODO: How should we handle this? Can we ignore it?
-		log.Error("Unknown or invalid config name")
+	} else if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		// Depending on the version, the agent responds with either status code if the config does not exist
+		return fmt.Errorf("DeleteScrapeConfig: %w", withKind(ErrConfigNotFound, describeStatus(resp)))
 	} else {
-		return fmt.Errorf("DeleteScrapeConfig: unexpected status code: %s", resp.Status)
+		return fmt.Errorf("DeleteScrapeConfig: %w", unexpectedStatus(resp))
 	}
 
 	return nil
 }
 
+// maxErrorMessageLength limits how much of an error response from the agent is included in errors so they still
+// fit in events and log lines
+const maxErrorMessageLength = 512
+
+// agentValidationErrors are the prefixes of the errors the agent responds with when it fails to unmarshal a config
+// or to apply defaults to it
+var agentValidationErrors = []string{
+	"yaml: ",
+	"missing instance name",
+	"wal_truncate_frequency must be",
+	"remote_flush_deadline must be",
+	"min_wal_time must be",
+	"empty or null",
+	"scrape timeout greater than scrape interval",
+	"scrape interval greater than wal_truncate_frequency",
+	"found multiple scrape configs",
+}
+
+// isAgentValidationError returns true if msg is one of the agentValidationErrors
+func isAgentValidationError(msg string) bool {
+	for _, prefix := range agentValidationErrors {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unexpectedStatus creates an error for a response with an unexpected status code, classified by its status code.
+// Only a 5xx without an error payload means the agent is unavailable, otherwise the agent handled the request and
+// the error is left unclassified.
+func unexpectedStatus(resp *http.Response) error {
+	var kind error
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		kind = ErrConfigNotFound
+	case resp.StatusCode == http.StatusBadRequest:
+		kind = ErrInvalidConfig
+	case httputil.IsUnavailable(resp):
+		kind = ErrAgentUnavailable
+	}
+
+	return withKind(kind, describeStatus(resp))
+}
+
+// describeStatus creates an error for a response with an unexpected status code, including the reason the agent
+// gave for the error if there is one
+func describeStatus(resp *http.Response) error {
+	return statusError(resp, errorMessage(resp))
+}
+
+func statusError(resp *http.Response, msg string) error {
+	if msg == "" {
+		return fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+
+	return fmt.Errorf("unexpected status code: %s: %s", resp.Status, msg)
+}
+
+// errorMessage reads the reason the agent gave for an error from the body of resp, or the body itself if it is not
+// an error payload
+func errorMessage(resp *http.Response) string {
+	type errorResponse struct {
+		Status string `json:"status"`
+		Data   struct {
+			Error string `json:"error"`
+		} `json:"data"`
+	}
+
+	raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4*maxErrorMessageLength))
+
+	msg := strings.TrimSpace(string(raw))
+	payload := errorResponse{}
+	if err := json.Unmarshal(raw, &payload); err == nil && payload.Data.Error != "" {
+		msg = payload.Data.Error
+	}
+
+	if len(msg) > maxErrorMessageLength {
+		// Don't leave half of a multi-byte character at the end
+		msg = strings.ToValidUTF8(msg[:maxErrorMessageLength], "") + "..."
+	}
+
+	return msg
+}
+
 type noopConfigManager struct{}
 
 func NewNoOpConfigManager() *noopConfigManager {
@@ -146,6 +336,10 @@ func (n *noopConfigManager) ListScrapeConfigs() ([]string, error) {
 	return nil, nil
 }
 
+func (n *noopConfigManager) GetScrapeConfig(_ string) (*instance.Config, error) {
+	return nil, nil
+}
+
 func (n *noopConfigManager) UpdateScrapeConfig(_ *instance.Config) error {
 	return nil
 }
@@ -153,3 +347,86 @@ func (n *noopConfigManager) UpdateScrapeConfig(_ *instance.Config) error {
 func (n *noopConfigManager) DeleteScrapeConfig(_ *instance.Config) error {
 	return nil
 }
+
+// dryRunConfigManager reads configs from the wrapped ConfigManager but only logs the updates and deletes it would
+// make. Secrets are scrubbed from the logged configs.
+type dryRunConfigManager struct {
+	inner ConfigManager
+
+	outLock sync.Mutex
+	out     io.Writer
+
+	log logrus.Ext1FieldLogger
+}
+
+// NewDryRunConfigManager wraps inner so that updates and deletes are logged instead of applied. If out is not nil,
+// each config that would be updated or deleted is also written to it as a YAML document.
+func NewDryRunConfigManager(inner ConfigManager, out io.Writer) *dryRunConfigManager {
+	return &dryRunConfigManager{
+		inner: inner,
+		out:   out,
+
+		log: logrus.WithField("prefix", "configManager/dryRun"),
+	}
+}
+
+func (d *dryRunConfigManager) ListScrapeConfigs() ([]string, error) {
+	return d.inner.ListScrapeConfigs()
+}
+
+func (d *dryRunConfigManager) WaitUntilAvailable(ctx context.Context) error {
+	if w, ok := d.inner.(availabilityWaiter); ok {
+		return w.WaitUntilAvailable(ctx)
+	}
+
+	return nil
+}
+
+func (d *dryRunConfigManager) GetScrapeConfig(name string) (*instance.Config, error) {
+	return d.inner.GetScrapeConfig(name)
+}
+
+func (d *dryRunConfigManager) UpdateScrapeConfig(cfg *instance.Config) error {
+	raw, err := instance.MarshalConfig(cfg, true)
+	if err != nil {
+		return fmt.Errorf("UpdateScrapeConfig: failed to marshal config: %w", err)
+	}
+
+	d.record("update", cfg.Name, raw)
+	return nil
+}
+
+func (d *dryRunConfigManager) DeleteScrapeConfig(cfg *instance.Config) error {
+	// Callers usually only know the name of the config to delete, so show what is currently stored in the agent
+	var raw []byte
+	if live, err := d.inner.GetScrapeConfig(cfg.Name); errors.Is(err, ErrConfigNotFound) {
+		return fmt.Errorf("DeleteScrapeConfig: %w", err)
+	} else if err != nil {
+		d.log.WithField("config", cfg.Name).WithError(err).Warn("Failed to fetch config that would be deleted")
+	} else if live != nil {
+		if raw, err = instance.MarshalConfig(live, true); err != nil {
+			return fmt.Errorf("DeleteScrapeConfig: failed to marshal config: %w", err)
+		}
+	}
+
+	d.record("delete", cfg.Name, raw)
+	return nil
+}
+
+func (d *dryRunConfigManager) record(action, name string, raw []byte) {
+	d.log.WithFields(logrus.Fields{
+		"action": action,
+		"config": name,
+	}).Infof("Dry run, not applying change:\n%s", raw)
+
+	if d.out == nil {
+		return
+	}
+
+	d.outLock.Lock()
+	defer d.outLock.Unlock()
+
+	if _, err := fmt.Fprintf(d.out, "---\n# %s %s\n%s", action, name, raw); err != nil {
+		d.log.WithError(err).Error("Failed to write dry run output")
+	}
+}
@@ -1,13 +1,19 @@
 package operator
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/httputil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -20,6 +26,85 @@ func TestNewNoOpConfigManager(t *testing.T) {
 	assert.NoError(t, sut.UpdateScrapeConfig(nil))
 }
 
+func TestGrafanaAgentConfigManagerResilience(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	var methods []string
+	codes := []int{http.StatusBadGateway, http.StatusOK, -1, http.StatusBadGateway}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+
+		code := codes[0]
+		if len(codes) > 1 {
+			codes = codes[1:]
+		}
+
+		// The agent fails to store the config in its KV store
+		if code == -1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"status":"error","data":{"error":"failed to CAS-update key dummy"}}`))
+			return
+		}
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	breaker := httputil.NewCircuitBreaker(1, time.Hour)
+	sut := NewGrafanaAgentConfigManager(
+		server.URL,
+		WithRetryPolicy(httputil.RetryPolicy{MaxRetries: 1}),
+		WithCircuitBreaker(breaker),
+	)
+
+	require.NoError(t, sut.UpdateScrapeConfig(&instance.Config{Name: "dummy"}))
+	assert.Equal(t, []string{http.MethodPut, http.MethodPut}, methods, "update was not retried")
+	assert.NoError(t, sut.WaitUntilAvailable(context.Background()))
+
+	methods = nil
+	require.Error(t, sut.UpdateScrapeConfig(&instance.Config{Name: "dummy"}))
+	assert.Equal(t, []string{http.MethodPut}, methods, "update with an error payload was retried")
+
+	err := sut.UpdateScrapeConfig(&instance.Config{Name: "dummy"})
+	require.True(t, errors.Is(err, httputil.ErrCircuitOpen), "expected the failed update to open the breaker, got %v", err)
+
+	breaker.Success()
+	methods = nil
+	require.Error(t, sut.DeleteScrapeConfig(&instance.Config{Name: "dummy"}))
+
+	err = sut.DeleteScrapeConfig(&instance.Config{Name: "dummy"})
+	require.True(t, errors.Is(err, httputil.ErrCircuitOpen), "expected the breaker to be open, got %v", err)
+	assert.Equal(t, []string{http.MethodDelete, http.MethodDelete}, methods, "request was sent while the breaker was open")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, sut.WaitUntilAvailable(ctx))
+}
+
+func TestDryRunConfigManager(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	live := &instance.Config{Name: "existing"}
+	inner := memoryConfigManager{"existing": live}
+
+	var out bytes.Buffer
+	sut := NewDryRunConfigManager(inner, &out)
+
+	names, err := sut.ListScrapeConfigs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"existing"}, names)
+
+	cfg, err := sut.GetScrapeConfig("existing")
+	require.NoError(t, err)
+	assert.Same(t, live, cfg)
+
+	require.NoError(t, sut.UpdateScrapeConfig(&instance.Config{Name: "new"}))
+	require.NoError(t, sut.DeleteScrapeConfig(&instance.Config{Name: "existing"}))
+
+	assert.Equal(t, memoryConfigManager{"existing": live}, inner, "dry run must not modify the wrapped manager")
+	assert.Contains(t, out.String(), "---\n# update new\nname: new\n")
+	assert.Contains(t, out.String(), "---\n# delete existing\nname: existing\n")
+}
+
 func makeMockAgentServerWithBody(code int, body string) (*string, *httptest.Server, *grafanaAgentConfigManager) {
 	var path string
 
@@ -81,11 +166,70 @@ func TestGrafanaAgentConfigManager(t *testing.T) {
 		assert.Contains(t, cfgs, "c")
 	})
 
+	t.Run("GetScrapeConfig", func(t *testing.T) {
+		path, server, sut := makeMockAgentServerWithBody(http.StatusOK, `{
+  "status": "success",
+  "data": {
+    "value": "name: foo/bar\nscrape_configs:\n- job_name: foo/bar\n"
+  }
+}`)
+		defer server.Close()
+
+		result, err := sut.GetScrapeConfig("foo/bar")
+		assertResponse(t, path, "/agent/api/v1/configs/foo/bar", nil, err)
+
+		assert.Equal(t, "foo/bar", result.Name)
+		require.Len(t, result.ScrapeConfigs, 1)
+		assert.Equal(t, "foo/bar", result.ScrapeConfigs[0].JobName)
+	})
+
+	t.Run("GetScrapeConfig Errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			code     int
+			body     string
+			expected error
+			kind     error
+		}{
+			{
+				name:     "Not Found",
+				code:     http.StatusBadRequest,
+				body:     `{"status":"error","data":{"error":"configuration foo/bar does not exist"}}`,
+				expected: fmt.Errorf("GetScrapeConfig: unexpected status code: 400 Bad Request: configuration foo/bar does not exist"),
+				kind:     ErrConfigNotFound,
+			},
+			{
+				name:     "Unavailable",
+				code:     http.StatusServiceUnavailable,
+				expected: fmt.Errorf("GetScrapeConfig: unexpected status code: 503 Service Unavailable"),
+				kind:     ErrAgentUnavailable,
+			},
+			{
+				name:     "Agent Error",
+				code:     http.StatusInternalServerError,
+				body:     `{"status":"error","data":{"error":"failed to get config"}}`,
+				expected: fmt.Errorf("GetScrapeConfig: unexpected status code: 500 Internal Server Error: failed to get config"),
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				path, server, sut := makeMockAgentServerWithBody(tt.code, tt.body)
+				defer server.Close()
+
+				_, err := sut.GetScrapeConfig("foo/bar")
+				assertResponse(t, path, "/agent/api/v1/configs/foo/bar", tt.expected, err)
+				assertKind(t, tt.kind, err)
+			})
+		}
+	})
+
 	t.Run("UpdateScrapeConfig", func(t *testing.T) {
 		tests := []struct {
 			name     string
 			code     int
+			body     string
 			expected error
+			kind     error
 		}{
 			{name: "Created", code: http.StatusCreated},
 			{name: "Updated", code: http.StatusOK},
@@ -93,15 +237,52 @@ func TestGrafanaAgentConfigManager(t *testing.T) {
 				name:     "Error",
 				code:     http.StatusInternalServerError,
 				expected: fmt.Errorf("UpdateScrapeConfig: unexpected status code: 500 Internal Server Error"),
+				kind:     ErrAgentUnavailable,
+			},
+			{
+				name:     "Agent Error",
+				code:     http.StatusBadRequest,
+				body:     `{"status":"error","data":{"error":"failed to validate instance dummy: invalid relabel action"}}`,
+				expected: fmt.Errorf("UpdateScrapeConfig: unexpected status code: 400 Bad Request: failed to validate instance dummy: invalid relabel action"),
+				kind:     ErrInvalidConfig,
+			},
+			{
+				name:     "Agent Rejected",
+				code:     http.StatusInternalServerError,
+				body:     `{"status":"error","data":{"error":"yaml: unmarshal errors"}}`,
+				expected: fmt.Errorf("UpdateScrapeConfig: unexpected status code: 500 Internal Server Error: yaml: unmarshal errors"),
+				kind:     ErrInvalidConfig,
+			},
+			{
+				name:     "Agent Failed To Store",
+				code:     http.StatusInternalServerError,
+				body:     `{"status":"error","data":{"error":"failed to CAS-update key dummy: context deadline exceeded"}}`,
+				expected: fmt.Errorf("UpdateScrapeConfig: unexpected status code: 500 Internal Server Error: failed to CAS-update key dummy: context deadline exceeded"),
+				kind:     ErrAgentUnavailable,
+			},
+			{
+				name:     "Plain Text Error",
+				code:     http.StatusBadGateway,
+				body:     "upstream connect error\n",
+				expected: fmt.Errorf("UpdateScrapeConfig: unexpected status code: 502 Bad Gateway: upstream connect error"),
+				kind:     ErrAgentUnavailable,
+			},
+			{
+				name:     "Truncated Error",
+				code:     http.StatusBadRequest,
+				body:     strings.Repeat("x", 2*maxErrorMessageLength),
+				expected: fmt.Errorf("UpdateScrapeConfig: unexpected status code: 400 Bad Request: %s...", strings.Repeat("x", maxErrorMessageLength)),
+				kind:     ErrInvalidConfig,
 			},
 		}
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
-				path, server, sut := makeMockAgentServer(tt.code)
+				path, server, sut := makeMockAgentServerWithBody(tt.code, tt.body)
 				defer server.Close()
 
 				err := sut.UpdateScrapeConfig(cfg)
 				assertResponse(t, path, "/agent/api/v1/config/dummy", tt.expected, err)
+				assertKind(t, tt.kind, err)
 			})
 		}
 	})
@@ -110,23 +291,39 @@ func TestGrafanaAgentConfigManager(t *testing.T) {
 		tests := []struct {
 			name     string
 			code     int
+			body     string
 			expected error
+			kind     error
 		}{
 			{name: "Deleted", code: http.StatusOK},
-			{name: "Bad Name", code: http.StatusBadRequest},
+			{
+				name:     "Bad Name",
+				code:     http.StatusBadRequest,
+				body:     `{"status":"error","data":{"error":"configuration dummy does not exist"}}`,
+				expected: fmt.Errorf("DeleteScrapeConfig: unexpected status code: 400 Bad Request: configuration dummy does not exist"),
+				kind:     ErrConfigNotFound,
+			},
+			{
+				name:     "Not Found",
+				code:     http.StatusNotFound,
+				expected: fmt.Errorf("DeleteScrapeConfig: unexpected status code: 404 Not Found"),
+				kind:     ErrConfigNotFound,
+			},
 			{
 				name:     "Error",
 				code:     http.StatusInternalServerError,
 				expected: fmt.Errorf("DeleteScrapeConfig: unexpected status code: 500 Internal Server Error"),
+				kind:     ErrAgentUnavailable,
 			},
 		}
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
-				path, server, sut := makeMockAgentServer(tt.code)
+				path, server, sut := makeMockAgentServerWithBody(tt.code, tt.body)
 				defer server.Close()
 
 				err := sut.DeleteScrapeConfig(cfg)
 				assertResponse(t, path, "/agent/api/v1/config/dummy", tt.expected, err)
+				assertKind(t, tt.kind, err)
 			})
 		}
 	})
@@ -141,3 +338,9 @@ func assertResponse(t *testing.T, path *string, expectedPath string, expected, e
 		require.NoError(t, err)
 	}
 }
+
+func assertKind(t *testing.T, expected, err error) {
+	for _, kind := range []error{ErrConfigNotFound, ErrInvalidConfig, ErrAgentUnavailable} {
+		assert.Equal(t, kind == expected, errors.Is(err, kind), "errors.Is(%v, %v)", err, kind)
+	}
+}
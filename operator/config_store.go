@@ -0,0 +1,192 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ErrConfigMapTooLarge is returned by a ConfigMap ConfigStore when an update would exceed the size limit of a ConfigMap
+var ErrConfigMapTooLarge = errors.New("config map too large")
+
+// maxConfigMapSize is the limit the API server enforces on the combined size of the keys and values of a ConfigMap
+const maxConfigMapSize = corev1.MaxSecretSize
+
+// ConfigStore holds the agent config file that a config file ConfigManager manages instance configs in
+type ConfigStore interface {
+	// Read returns the contents of the agent config file, which are empty if it does not exist yet
+	Read() ([]byte, error)
+	// Update calls fn with the contents of the agent config file and replaces them with the result, unless fn
+	// returns an error or the result is unchanged. Concurrent updates are serialized.
+	Update(fn func(current []byte) ([]byte, error)) error
+	// String describes where the agent config file is stored
+	String() string
+}
+
+type fileConfigStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFileConfigStore stores the agent config in a local file. The file is replaced atomically so agents never
+// read a partially written config.
+func NewFileConfigStore(path string) *fileConfigStore {
+	return &fileConfigStore{path: path}
+}
+
+func (f *fileConfigStore) Read() ([]byte, error) {
+	raw, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return raw, err
+}
+
+func (f *fileConfigStore) Update(fn func(current []byte) ([]byte, error)) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	current, err := f.Read()
+	if err != nil {
+		return err
+	}
+
+	updated, err := fn(current)
+	if err != nil {
+		return err
+	} else if current != nil && bytes.Equal(current, updated) {
+		// Replacing the file changes its inode and mtime, which would restart agents that watch it for no reason
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(updated); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *fileConfigStore) String() string {
+	return "file://" + f.path
+}
+
+type configMapConfigStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+}
+
+// NewConfigMapConfigStore stores the agent config in the specified key of a ConfigMap, which is created if it
+// does not exist. Conflicting updates are retried. The config is not split across keys or ConfigMaps, so updates
+// that would exceed the size limit of a ConfigMap fail with ErrConfigMapTooLarge.
+func NewConfigMapConfigStore(client kubernetes.Interface, namespace, name, key string) *configMapConfigStore {
+	return &configMapConfigStore{client: client, namespace: namespace, name: name, key: key}
+}
+
+func (c *configMapConfigStore) Read() ([]byte, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(context.Background(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []byte(cm.Data[c.key]), nil
+}
+
+func (c *configMapConfigStore) Update(fn func(current []byte) ([]byte, error)) error {
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		ctx := context.Background()
+		client := c.client.CoreV1().ConfigMaps(c.namespace)
+
+		cm, err := client.Get(ctx, c.name, metav1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: c.namespace, Name: c.name}}
+		} else if err != nil {
+			return err
+		}
+
+		current, ok := cm.Data[c.key]
+		updated, err := fn([]byte(current))
+		if err != nil {
+			return err
+		} else if ok && current == string(updated) {
+			return nil
+		}
+
+		cm = cm.DeepCopy()
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[c.key] = string(updated)
+
+		if size := configMapSize(cm); size > maxConfigMapSize {
+			return fmt.Errorf(
+				"%w: %s would be %d bytes, more than the limit of %d bytes",
+				ErrConfigMapTooLarge, c, size, maxConfigMapSize,
+			)
+		}
+
+		if exists {
+			_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+		} else {
+			_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+		}
+
+		return err
+	})
+}
+
+// configMapSize returns the size of cm as counted by the API server for its size limit
+func configMapSize(cm *corev1.ConfigMap) int {
+	size := 0
+	for k, v := range cm.Data {
+		size += len(k) + len(v)
+	}
+
+	for k, v := range cm.BinaryData {
+		size += len(k) + len(v)
+	}
+
+	return size
+}
+
+func (c *configMapConfigStore) String() string {
+	return fmt.Sprintf("configmap://%s/%s/%s", c.namespace, c.name, c.key)
+}
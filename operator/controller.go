@@ -2,8 +2,10 @@ package operator
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/grafana/agent/pkg/prom/instance"
@@ -12,8 +14,6 @@ import (
 	"github.com/prometheus-operator/prometheus-operator/pkg/client/informers/externalversions"
 	monitoringclientv1 "github.com/prometheus-operator/prometheus-operator/pkg/client/listers/monitoring/v1"
 	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned"
-	commonconfig "github.com/prometheus/common/config"
-	promcfg "github.com/prometheus/prometheus/config"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	corev1 "k8s.io/api/core/v1"
@@ -21,15 +21,27 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/deprecated/scheme"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
-const controllerAgentName = "grafana-agent-operator"
+const (
+	controllerAgentName = "grafana-agent-operator"
+
+	// kindStaleConfig is the kind of work item for agent configs that no longer belong to a ServiceMonitor. Its
+	// key is the name of the config to delete.
+	kindStaleConfig = "StaleConfig"
+
+	// kindListStaleConfigs is the kind of work item that lists the configs in the agent and queues the ones that
+	// no longer belong to a ServiceMonitor. It is queued once at startup and retried until the agent can be reached.
+	kindListStaleConfigs = "ListStaleConfigs"
+)
 
 type monitorTarget struct {
 	kind   string
@@ -41,18 +53,37 @@ type Controller struct {
 	k          kubernetes.Interface
 	monitoring versioned.Interface
 
-	factory externalversions.SharedInformerFactory
+	factory     externalversions.SharedInformerFactory
+	kubeFactory informers.SharedInformerFactory
 
 	serviceMonitorLister   monitoringclientv1.ServiceMonitorLister
 	serviceMoniotrInformer cache.SharedIndexInformer
 	removedServiceMonitors cache.Indexer
 
+	// namespaceLister and namespaceInformer are only set when labels are copied from namespaces
+	namespaceLister   corelisters.NamespaceLister
+	namespaceInformer cache.SharedIndexInformer
+
 	work     workqueue.RateLimitingInterface
 	events   record.EventBroadcaster
 	recorder record.EventRecorder
 
-	configWriter config.Writer
-	manager      ConfigManager
+	writerLock     sync.RWMutex
+	configWriter   config.Writer
+	apiServerToken string
+	manager        ConfigManager
+
+	// limitWarnings holds the LimitEnforced warnings last recorded for each ServiceMonitor, so the events are only
+	// recorded again when the ServiceMonitor or the limits change instead of on every sync
+	limitWarningsLock sync.Mutex
+	limitWarnings     map[string]string
+
+	agentURL      string
+	recordStatus  bool
+	useFinalizers bool
+	// removeFinalizers removes the finalizer from ServiceMonitors when finalizers are disabled
+	removeFinalizers bool
+	driftDryRun      bool
 
 	log logrus.FieldLogger
 }
@@ -68,24 +99,21 @@ func NewControllerForConfig(cfg *rest.Config, manager ConfigManager) (*Controlle
 		return nil, err
 	}
 
-	u, err := url.Parse(viper.GetString("remote-write-url"))
-	if err != nil {
-		return nil, err
-	}
-
 	factory := externalversions.NewSharedInformerFactory(monitoring, viper.GetDuration("relist"))
 	smi := factory.Monitoring().V1().ServiceMonitors()
-	writer := config.NewWriter(&instance.RemoteWriteConfig{
-		Base: promcfg.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}},
-	})
 
 	log := logrus.WithField("prefix", "controller")
 
+	// A dry run must not modify the cluster either, so events, status annotations and finalizers are disabled
+	dryRun := viper.GetBool("dry-run")
+
 	events := record.NewBroadcaster()
 	events.StartLogging(func(format string, args ...interface{}) {
 		logrus.WithField("prefix", "controller/event").Tracef(format, args...)
 	})
-	events.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8s.CoreV1().Events("")})
+	if !dryRun {
+		events.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8s.CoreV1().Events("")})
+	}
 	recorder := events.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
 	result := &Controller{
@@ -102,8 +130,13 @@ func NewControllerForConfig(cfg *rest.Config, manager ConfigManager) (*Controlle
 		events:   events,
 		recorder: recorder,
 
-		manager:      manager,
-		configWriter: writer,
+		manager: manager,
+
+		agentURL:         agentLocation(),
+		recordStatus:     viper.GetBool("record-status") && !dryRun,
+		useFinalizers:    viper.GetBool("finalizers") && !dryRun,
+		removeFinalizers: !viper.GetBool("finalizers") && !dryRun,
+		driftDryRun:      viper.GetBool("drift-dry-run"),
 
 		log: log,
 	}
@@ -120,11 +153,37 @@ func NewControllerForConfig(cfg *rest.Config, manager ConfigManager) (*Controlle
 				return
 			}
 
+			if onlyStatusChanged(oldSmi, newSmi) {
+				log.WithFields(fieldsForServiceMonitor(newSmi)).Debug("Ignoring sync status update")
+				return
+			}
+
 			result.enqueue(newObj)
 		},
 		DeleteFunc: result.enqueueDelete,
 	})
 
+	if len(viper.GetStringSlice("namespace-labels")) > 0 {
+		result.kubeFactory = informers.NewSharedInformerFactory(k8s, viper.GetDuration("relist"))
+		nsi := result.kubeFactory.Core().V1().Namespaces()
+		result.namespaceLister = nsi.Lister()
+		result.namespaceInformer = nsi.Informer()
+
+		nsi.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: result.enqueueForNamespace,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if !reflect.DeepEqual(oldObj.(*corev1.Namespace).Labels, newObj.(*corev1.Namespace).Labels) {
+					result.enqueueForNamespace(newObj)
+				}
+			},
+			DeleteFunc: result.enqueueForNamespace,
+		})
+	}
+
+	if result.configWriter, err = result.newWriter(); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
@@ -136,46 +195,41 @@ func (c *Controller) Run(ctx context.Context) error {
 	c.log.Info("Starting Controller")
 	go c.factory.Start(ctx.Done())
 
-	c.log.Info("Fetching existing configs")
-	existing, err := c.manager.ListScrapeConfigs()
-	if err != nil {
-		return fmt.Errorf("failed to list existing configs: %w", err)
-	}
-
-	knownServiceMonitors := map[string]struct{}{}
-	for _, sm := range existing {
-		knownServiceMonitors[sm] = struct{}{}
+	synced := []cache.InformerSynced{c.serviceMoniotrInformer.HasSynced}
+	if c.kubeFactory != nil {
+		go c.kubeFactory.Start(ctx.Done())
+		synced = append(synced, c.namespaceInformer.HasSynced)
 	}
 
 	c.log.Info("Warming up the cache")
 	warmup, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	ok := func() bool {
 		defer cancel()
-		return cache.WaitForCacheSync(warmup.Done(), c.serviceMoniotrInformer.HasSynced)
+		return cache.WaitForCacheSync(warmup.Done(), synced...)
 	}()
 	if !ok {
 		return fmt.Errorf("one or more caches failed to sync: %w", warmup.Err())
 	}
 
-	for _, obj := range c.serviceMoniotrInformer.GetStore().List() {
-		for _, cfg := range c.configWriter.ScrapeConfigsForServiceMonitor(obj.(*monitoringv1.ServiceMonitor)) {
-			delete(knownServiceMonitors, cfg.Name)
+	if sa, ttl, ok := apiServerTokenSettings(); ok {
+		expiry, err := c.mintAPIServerToken(ctx, sa, ttl)
+		if err != nil {
+			return err
 		}
-	}
 
-	c.log.Infof("Cleaning up %d service monitors that were removed while the operator was down", len(knownServiceMonitors))
-	for sm := range knownServiceMonitors {
-		log := c.log.WithField("name", sm)
-		log.Debug("Cleaning up removed ServiceMonitor")
-		// TODO: Somehow do this via the work queue instead?
-		if err := c.manager.DeleteScrapeConfig(&instance.Config{Name: sm}); err != nil {
-			log.WithError(err).Errorf("Failed to cleanup stale ServiceMonitor, ignoring...")
-		}
+		go c.runTokenRefresher(ctx, sa, ttl, expiry)
 	}
 
+	// Clean up ServiceMonitors that were removed while the operator was down
+	c.work.Add(monitorTarget{kind: kindListStaleConfigs})
+
 	c.log.Info("Starting Workers")
 	for i := 0; i < viper.GetInt("parallelism"); i++ {
-		go wait.Until(c.runWorker, time.Second, ctx.Done())
+		go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	}
+
+	if interval := viper.GetDuration("drift-interval"); interval > 0 {
+		go c.runDriftReconciler(ctx, interval)
 	}
 
 	<-ctx.Done()
@@ -183,9 +237,107 @@ func (c *Controller) Run(ctx context.Context) error {
 	return nil
 }
 
-func (c *Controller) runWorker() {
-	for c.reconcile() {
+// enqueueStaleConfigs queues the deletion of configs in the agent that do not belong to any ServiceMonitor in
+// the cache, such as configs for ServiceMonitors that were removed while the operator was down.
+func (c *Controller) enqueueStaleConfigs() error {
+	c.log.Info("Fetching existing configs")
+	existing, err := c.manager.ListScrapeConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to list existing configs: %w", err)
+	}
+
+	stale := map[string]struct{}{}
+	for _, name := range existing {
+		stale[name] = struct{}{}
+	}
+
+	for _, obj := range c.serviceMoniotrInformer.GetStore().List() {
+		for _, name := range config.InstanceNames(obj.(*monitoringv1.ServiceMonitor)) {
+			delete(stale, name)
+		}
+	}
+
+	c.log.Infof("Cleaning up %d configs for ServiceMonitors that were removed while the operator was down", len(stale))
+	for name := range stale {
+		c.log.WithField("config", name).Trace("enqueuing stale config delete")
+		c.work.Add(monitorTarget{kind: kindStaleConfig, key: name})
+	}
+
+	return nil
+}
+
+// ownsConfig returns true if a ServiceMonitor in the cache generates the config with the specified name
+func (c *Controller) ownsConfig(name string) (bool, error) {
+	ns, smName, _, ok := config.ParseInstanceName(name)
+	if !ok {
+		return false, nil
 	}
+
+	obj, exists, err := c.serviceMoniotrInformer.GetStore().GetByKey(ns + "/" + smName)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	for _, owned := range config.InstanceNames(obj.(*monitoringv1.ServiceMonitor)) {
+		if owned == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// deleteConfig deletes cfg from the agent, treating configs that do not exist as already deleted
+func (c *Controller) deleteConfig(name string) error {
+	err := c.manager.DeleteScrapeConfig(&instance.Config{Name: name})
+	if errors.Is(err, ErrConfigNotFound) {
+		c.log.WithField("config", name).Debug("Config was already deleted")
+		return nil
+	}
+
+	return err
+}
+
+func (c *Controller) writer() config.Writer {
+	c.writerLock.RLock()
+	defer c.writerLock.RUnlock()
+
+	return c.configWriter
+}
+
+// Reload rebuilds the config writer from the current operator settings and re-syncs all ServiceMonitors
+func (c *Controller) Reload() error {
+	writer, err := c.newWriter()
+	if err != nil {
+		return err
+	}
+
+	c.writerLock.Lock()
+	c.configWriter = writer
+	c.writerLock.Unlock()
+
+	c.log.Info("Reloaded settings, re-syncing all ServiceMonitors")
+	for _, obj := range c.serviceMoniotrInformer.GetStore().List() {
+		c.enqueue(obj)
+	}
+
+	return nil
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.waitForAgent(ctx) && c.reconcile(ctx) {
+	}
+}
+
+// waitForAgent pauses the worker while the agent is known to be unavailable instead of failing every item in the
+// queue. It returns false if ctx is done while waiting.
+func (c *Controller) waitForAgent(ctx context.Context) bool {
+	w, ok := c.manager.(availabilityWaiter)
+	if !ok {
+		return true
+	}
+
+	return w.WaitUntilAvailable(ctx) == nil
 }
 
 func fieldsForServiceMonitor(s *monitoringv1.ServiceMonitor) logrus.Fields {
@@ -225,3 +377,33 @@ func (c *Controller) enqueueDelete(obj interface{}) {
 	c.log.WithField("serviceMonitor", key).Trace("enqueuing delete")
 	c.work.Add(monitorTarget{kind: obj.(kubernetesruntime.Object).GetObjectKind().GroupVersionKind().Kind, key: key, delete: true})
 }
+
+// enqueueForNamespace re-syncs the ServiceMonitors that discover targets in the namespace, since the labels they
+// copy from it may have changed
+func (c *Controller) enqueueForNamespace(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+
+	for _, obj := range c.serviceMoniotrInformer.GetStore().List() {
+		if config.SelectsNamespace(obj.(*monitoringv1.ServiceMonitor), ns.Name) {
+			c.enqueue(obj)
+		}
+	}
+}
+
+// agentLocation describes where the configs are synced to, for the agent-url status annotation
+func agentLocation() string {
+	if path := viper.GetString("agent-config-file"); path != "" {
+		return NewFileConfigStore(path).String()
+	} else if cm := viper.GetString("agent-config-map"); cm != "" {
+		return fmt.Sprintf("configmap://%s/%s", cm, viper.GetString("agent-config-map-key"))
+	}
+
+	return viper.GetString("agent-url")
+}
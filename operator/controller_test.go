@@ -0,0 +1,50 @@
+package operator
+
+import (
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestEnqueueForNamespace(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := func(namespace, name string, selector monitoringv1.NamespaceSelector) *monitoringv1.ServiceMonitor {
+		return &monitoringv1.ServiceMonitor{
+			TypeMeta:   metav1.TypeMeta{Kind: monitoringv1.ServiceMonitorsKind},
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       monitoringv1.ServiceMonitorSpec{NamespaceSelector: selector},
+		}
+	}
+
+	sut := makeTestController(t, &noopConfigManager{},
+		sm("myapp", "own", monitoringv1.NamespaceSelector{}),
+		sm("other", "own", monitoringv1.NamespaceSelector{}),
+		sm("monitoring", "any", monitoringv1.NamespaceSelector{Any: true}),
+		sm("monitoring", "selected", monitoringv1.NamespaceSelector{MatchNames: []string{"myapp"}}),
+	)
+
+	keys := func() []string {
+		var result []string
+		for _, item := range drainQueue(sut) {
+			result = append(result, item.key)
+		}
+		sort.Strings(result)
+
+		return result
+	}
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "myapp"}}
+	sut.enqueueForNamespace(ns)
+	assert.Equal(t, []string{"monitoring/any", "monitoring/selected", "myapp/own"}, keys())
+
+	sut.enqueueForNamespace(cache.DeletedFinalStateUnknown{Key: "other", Obj: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}}})
+	assert.Equal(t, []string{"monitoring/any", "other/own"}, keys())
+}
@@ -0,0 +1,168 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	driftActionCreate = "create"
+	driftActionUpdate = "update"
+	driftActionDelete = "delete"
+)
+
+var configDriftTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grafana_agent_operator_config_drift_total",
+	Help: "Total number of agent configs that differed from the desired state, by the action required to correct them",
+}, []string{"action"})
+
+// runDriftReconciler periodically compares the configs stored in the agent with the configs generated from the
+// ServiceMonitors in the informer cache until the context is cancelled.
+func (c *Controller) runDriftReconciler(ctx context.Context, interval time.Duration) {
+	log := c.log.WithField("interval", interval)
+	log.Info("Starting drift reconciler")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.reconcileDrift(); err != nil {
+				log.WithError(err).Error("Failed to reconcile drift")
+			}
+		}
+	}
+}
+
+func (c *Controller) reconcileDrift() error {
+	c.log.Debug("Checking for config drift")
+	live, err := c.manager.ListScrapeConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to list existing configs: %w", err)
+	}
+
+	desired := map[string]*instance.Config{}
+	owners := map[string]*monitoringv1.ServiceMonitor{}
+	invalid := map[string]struct{}{}
+	for _, obj := range c.serviceMoniotrInformer.GetStore().List() {
+		sm := obj.(*monitoringv1.ServiceMonitor)
+		skip := func(err error) {
+			// Invalid ServiceMonitors are reported when they are synced, leave their existing configs alone
+			c.log.WithField("serviceMonitor", fmt.Sprintf("%s/%s", sm.Namespace, sm.Name)).WithError(err).Warn("Skipping invalid ServiceMonitor")
+			for _, name := range config.InstanceNames(sm) {
+				invalid[name] = struct{}{}
+			}
+		}
+
+		writer := c.writer()
+		if err := writer.Validate(sm); err != nil {
+			skip(err)
+			continue
+		}
+
+		cfgs, _, err := writer.ScrapeConfigsForServiceMonitor(sm)
+		if err != nil {
+			skip(err)
+			continue
+		}
+
+		for _, cfg := range cfgs {
+			desired[cfg.Name] = cfg
+			owners[cfg.Name] = sm
+		}
+	}
+
+	resync := map[*monitoringv1.ServiceMonitor]struct{}{}
+	for _, name := range live {
+		if _, skip := invalid[name]; skip {
+			continue
+		}
+
+		cfg, ok := desired[name]
+		if !ok {
+			c.driftDetected(driftActionDelete, logrus.Fields{"config": name}, func() {
+				c.work.Add(monitorTarget{kind: kindStaleConfig, key: name})
+			})
+			continue
+		}
+
+		delete(desired, name)
+		if _, queued := resync[owners[name]]; queued {
+			continue
+		}
+
+		changed, err := c.configChanged(cfg)
+		if err != nil {
+			c.log.WithField("config", name).WithError(err).Warn("Failed to compare config, skipping")
+			continue
+		}
+
+		if changed {
+			resync[owners[name]] = struct{}{}
+			c.driftDetected(driftActionUpdate, logrus.Fields{"config": name}, func() {
+				c.enqueue(owners[name])
+			})
+		}
+	}
+
+	for name := range desired {
+		if _, queued := resync[owners[name]]; queued {
+			continue
+		}
+
+		resync[owners[name]] = struct{}{}
+		c.driftDetected(driftActionCreate, logrus.Fields{"config": name}, func() {
+			c.enqueue(owners[name])
+		})
+	}
+
+	return nil
+}
+
+// configChanged compares the normalized form of the desired config with the config stored in the agent
+func (c *Controller) configChanged(cfg *instance.Config) (bool, error) {
+	expected, err := config.Normalize(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	existing, err := c.manager.GetScrapeConfig(cfg.Name)
+	if errors.Is(err, ErrConfigNotFound) {
+		// Deleted since the configs were listed
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	actual, err := config.Normalize(existing)
+	if err != nil {
+		return false, err
+	}
+
+	return expected != actual, nil
+}
+
+func (c *Controller) driftDetected(action string, fields logrus.Fields, fix func()) {
+	configDriftTotal.WithLabelValues(action).Inc()
+
+	log := c.log.WithFields(fields).WithField("action", action)
+	if c.driftDryRun {
+		log.Info("Detected config drift, not correcting it in dry-run mode")
+		return
+	}
+
+	log.Info("Detected config drift")
+	fix()
+}
@@ -0,0 +1,182 @@
+package operator
+
+import (
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/informers/externalversions"
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned/fake"
+	commonconfig "github.com/prometheus/common/config"
+	promcfg "github.com/prometheus/prometheus/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+type memoryConfigManager map[string]*instance.Config
+
+func (m memoryConfigManager) ListScrapeConfigs() ([]string, error) {
+	var result []string
+	for name := range m {
+		result = append(result, name)
+	}
+
+	return result, nil
+}
+
+func (m memoryConfigManager) GetScrapeConfig(name string) (*instance.Config, error) {
+	return m[name], nil
+}
+
+func (m memoryConfigManager) UpdateScrapeConfig(cfg *instance.Config) error {
+	m[cfg.Name] = cfg
+	return nil
+}
+
+func (m memoryConfigManager) DeleteScrapeConfig(cfg *instance.Config) error {
+	delete(m, cfg.Name)
+	return nil
+}
+
+func testWriter() config.Writer {
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	return config.NewWriter(&instance.RemoteWriteConfig{Base: promcfg.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}})
+}
+
+func makeTestController(t *testing.T, manager ConfigManager, sms ...*monitoringv1.ServiceMonitor) *Controller {
+	informer := externalversions.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Monitoring().V1().ServiceMonitors().Informer()
+	for _, sm := range sms {
+		require.NoError(t, informer.GetIndexer().Add(sm))
+	}
+
+	return &Controller{
+		serviceMoniotrInformer: informer,
+		removedServiceMonitors: cache.NewIndexer(cache.DeletionHandlingMetaNamespaceKeyFunc, cache.Indexers{}),
+		work:                   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		configWriter:           testWriter(),
+		manager:                manager,
+		log:                    logrus.StandardLogger(),
+	}
+}
+
+func drainQueue(c *Controller) []monitorTarget {
+	var result []monitorTarget
+	for c.work.Len() > 0 {
+		item, _ := c.work.Get()
+		c.work.Done(item)
+		result = append(result, item.(monitorTarget))
+	}
+
+	return result
+}
+
+func TestReconcileDrift(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := func(name string, endpoints int) *monitoringv1.ServiceMonitor {
+		return &monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "myapp"},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: make([]monitoringv1.Endpoint, endpoints)},
+		}
+	}
+
+	inSync, modified, missing := sm("in-sync", 1), sm("modified", 2), sm("missing", 1)
+
+	manager := memoryConfigManager{}
+	for _, s := range []*monitoringv1.ServiceMonitor{inSync, modified} {
+		cfgs, _, err := testWriter().ScrapeConfigsForServiceMonitor(s)
+		require.NoError(t, err)
+		for _, cfg := range cfgs {
+			require.NoError(t, manager.UpdateScrapeConfig(cfg))
+		}
+	}
+
+	manager["myapp/modified/1"].ScrapeConfigs[0].MetricsPath = "/edited"
+	manager["myapp/removed/0"] = &instance.Config{Name: "myapp/removed/0"}
+
+	t.Run("Queues Fixes", func(t *testing.T) {
+		sut := makeTestController(t, manager, inSync, modified, missing)
+		require.NoError(t, sut.reconcileDrift())
+
+		queued := drainQueue(sut)
+		assert.Len(t, queued, 3)
+		assert.Contains(t, queued, monitorTarget{key: "myapp/modified"})
+		assert.Contains(t, queued, monitorTarget{key: "myapp/missing"})
+		assert.Contains(t, queued, monitorTarget{kind: kindStaleConfig, key: "myapp/removed/0"})
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		sut := makeTestController(t, manager, inSync, modified, missing)
+		sut.driftDryRun = true
+		require.NoError(t, sut.reconcileDrift())
+
+		assert.Zero(t, sut.work.Len())
+	})
+
+	t.Run("Skips Invalid", func(t *testing.T) {
+		invalid := sm("invalid", 1)
+		invalid.Spec.Endpoints[0].Port = "web("
+		manager["myapp/invalid/0"] = &instance.Config{Name: "myapp/invalid/0"}
+		defer delete(manager, "myapp/invalid/0")
+
+		sut := makeTestController(t, manager, inSync, modified, missing, invalid)
+		require.NotPanics(t, func() {
+			require.NoError(t, sut.reconcileDrift())
+		})
+
+		queued := drainQueue(sut)
+		assert.Len(t, queued, 3)
+		assert.NotContains(t, queued, monitorTarget{key: "myapp/invalid"})
+		assert.NotContains(t, queued, monitorTarget{kind: kindStaleConfig, key: "myapp/invalid/0"})
+	})
+}
+
+func TestEnqueueStaleConfigs(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	manager := memoryConfigManager{
+		"myapp/live/0":    &instance.Config{Name: "myapp/live/0"},
+		"myapp/removed/0": &instance.Config{Name: "myapp/removed/0"},
+		"myapp/removed/1": &instance.Config{Name: "myapp/removed/1"},
+	}
+
+	sut := makeTestController(t, manager, &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "live", Namespace: "myapp"},
+		Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{}}},
+	})
+	require.NoError(t, sut.enqueueStaleConfigs())
+
+	queued := drainQueue(sut)
+	assert.Len(t, queued, 2)
+	assert.Contains(t, queued, monitorTarget{kind: kindStaleConfig, key: "myapp/removed/0"})
+	assert.Contains(t, queued, monitorTarget{kind: kindStaleConfig, key: "myapp/removed/1"})
+}
+
+func TestDeleteStaleConfig(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	manager := memoryConfigManager{
+		"myapp/live/0":    &instance.Config{Name: "myapp/live/0"},
+		"myapp/live/1":    &instance.Config{Name: "myapp/live/1"},
+		"myapp/removed/0": &instance.Config{Name: "myapp/removed/0"},
+	}
+
+	// The ServiceMonitor was created after its config was queued as stale
+	sut := makeTestController(t, manager, &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "live", Namespace: "myapp"},
+		Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{}}},
+	})
+
+	for _, name := range []string{"myapp/live/0", "myapp/live/1", "myapp/removed/0"} {
+		require.NoError(t, sut.deleteStaleConfig(name))
+	}
+
+	assert.Equal(t, memoryConfigManager{"myapp/live/0": &instance.Config{Name: "myapp/live/0"}}, manager)
+}
@@ -0,0 +1,50 @@
+package operator
+
+import (
+	"errors"
+)
+
+var (
+	// ErrConfigNotFound is returned by a ConfigManager when a config does not exist in the agent
+	ErrConfigNotFound = errors.New("config not found")
+
+	// ErrInvalidConfig is returned by a ConfigManager when the agent rejects a config. Retrying the same config
+	// will not succeed.
+	ErrInvalidConfig = errors.New("invalid config")
+
+	// ErrAgentUnavailable is returned by a ConfigManager when the agent cannot be reached or fails to handle a
+	// request. Retrying later may succeed.
+	ErrAgentUnavailable = errors.New("agent unavailable")
+)
+
+// configManagerError classifies err as one of the ConfigManager errors without changing its message
+type configManagerError struct {
+	kind error
+	err  error
+}
+
+func withKind(kind, err error) error {
+	if kind == nil {
+		return err
+	}
+
+	return &configManagerError{kind: kind, err: err}
+}
+
+func (e *configManagerError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configManagerError) Unwrap() error {
+	return e.err
+}
+
+func (e *configManagerError) Is(target error) bool {
+	return target == e.kind
+}
+
+// isPermanent returns true if retrying the work item that failed with err cannot succeed until the
+// ServiceMonitor is changed
+func isPermanent(err error) bool {
+	return errors.Is(err, ErrInvalidConfig)
+}
@@ -0,0 +1,160 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	monitoringclientv1 "github.com/prometheus-operator/prometheus-operator/pkg/client/listers/monitoring/v1"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	promcfg "github.com/prometheus/prometheus/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+type failingConfigManager struct {
+	noopConfigManager
+
+	err error
+}
+
+func (f *failingConfigManager) ListScrapeConfigs() ([]string, error) {
+	return nil, f.err
+}
+
+func (f *failingConfigManager) UpdateScrapeConfig(_ *instance.Config) error {
+	return f.err
+}
+
+func (f *failingConfigManager) DeleteScrapeConfig(_ *instance.Config) error {
+	return f.err
+}
+
+func TestReconcileErrors(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Port: "a"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		target   monitorTarget
+		err      error
+		requeued bool
+	}{
+		{name: "Sync", target: monitorTarget{key: "myapp/dummy"}},
+		{name: "Sync Agent Unavailable", target: monitorTarget{key: "myapp/dummy"}, err: withKind(ErrAgentUnavailable, fmt.Errorf("dummy")), requeued: true},
+		{name: "Sync Invalid Config", target: monitorTarget{key: "myapp/dummy"}, err: withKind(ErrInvalidConfig, fmt.Errorf("dummy"))},
+		{name: "Delete Not Found", target: monitorTarget{key: "myapp/dummy", delete: true}, err: withKind(ErrConfigNotFound, fmt.Errorf("dummy"))},
+		{name: "Delete Stale Not Found", target: monitorTarget{kind: kindStaleConfig, key: "myapp/other/0"}, err: withKind(ErrConfigNotFound, fmt.Errorf("dummy"))},
+		{name: "Delete Agent Unavailable", target: monitorTarget{kind: kindStaleConfig, key: "myapp/other/0"}, err: withKind(ErrAgentUnavailable, fmt.Errorf("dummy")), requeued: true},
+		{name: "Delete Stale Owned", target: monitorTarget{kind: kindStaleConfig, key: "myapp/dummy/0"}, err: withKind(ErrAgentUnavailable, fmt.Errorf("dummy"))},
+		{name: "List Stale", target: monitorTarget{kind: kindListStaleConfigs}},
+		{name: "List Stale Agent Unavailable", target: monitorTarget{kind: kindListStaleConfigs}, err: withKind(ErrAgentUnavailable, fmt.Errorf("dummy")), requeued: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := makeTestController(t, &failingConfigManager{err: tt.err}, sm.DeepCopy())
+			sut.serviceMonitorLister = monitoringclientv1.NewServiceMonitorLister(sut.serviceMoniotrInformer.GetIndexer())
+			sut.recorder = record.NewFakeRecorder(10)
+
+			sut.work.Add(tt.target)
+			assert.True(t, sut.reconcile(context.Background()))
+
+			if tt.requeued {
+				assert.Equal(t, 1, sut.work.NumRequeues(tt.target))
+			} else {
+				assert.Equal(t, 0, sut.work.NumRequeues(tt.target))
+			}
+		})
+	}
+}
+
+func TestReconcileInvalidServiceMonitor(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Port: "a", Interval: "10s", ScrapeTimeout: "30s"}},
+		},
+	}
+
+	// The agent being unavailable would requeue the ServiceMonitor if the config was pushed
+	sut := makeTestController(t, &failingConfigManager{err: withKind(ErrAgentUnavailable, fmt.Errorf("dummy"))}, sm)
+	sut.serviceMonitorLister = monitoringclientv1.NewServiceMonitorLister(sut.serviceMoniotrInformer.GetIndexer())
+	recorder := record.NewFakeRecorder(10)
+	sut.recorder = recorder
+
+	target := monitorTarget{key: "myapp/dummy"}
+	sut.work.Add(target)
+	assert.True(t, sut.reconcile(context.Background()))
+
+	assert.Equal(t, 0, sut.work.NumRequeues(target))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, FailedValidation)
+}
+
+func TestReconcileLimitEnforcedEvents(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp", Generation: 1},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Port: "a", Interval: "1s"}},
+		},
+	}
+
+	sut := makeTestController(t, &noopConfigManager{}, sm)
+	sut.serviceMonitorLister = monitoringclientv1.NewServiceMonitorLister(sut.serviceMoniotrInformer.GetIndexer())
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	sut.configWriter = config.NewWriter(
+		&instance.RemoteWriteConfig{Base: promcfg.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}},
+		config.WithLimits(config.Limits{MinInterval: model.Duration(10 * time.Second)}),
+	)
+	recorder := record.NewFakeRecorder(10)
+	sut.recorder = recorder
+
+	limitEvents := func() int {
+		count := 0
+		for len(recorder.Events) > 0 {
+			if strings.Contains(<-recorder.Events, LimitEnforced) {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	sync := func() {
+		sut.work.Add(monitorTarget{key: "myapp/dummy"})
+		require.True(t, sut.reconcile(context.Background()))
+	}
+
+	sync()
+	assert.Equal(t, 1, limitEvents())
+
+	sync()
+	assert.Zero(t, limitEvents(), "the warning was recorded again for the same generation")
+
+	updated := sm.DeepCopy()
+	updated.Generation = 2
+	require.NoError(t, sut.serviceMoniotrInformer.GetIndexer().Update(updated))
+	sync()
+	assert.Equal(t, 1, limitEvents(), "the warning was not recorded for the new generation")
+}
@@ -0,0 +1,89 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlowe/grafana-agent-operator/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Finalizer is added to each ServiceMonitor when running with --finalizers so the operator gets a chance to
+// delete the agent configs for a ServiceMonitor before it is removed from the cluster, even if the operator
+// is down when the ServiceMonitor is deleted.
+const Finalizer = "grafana-agent-operator/cleanup"
+
+func hasFinalizer(sm *monitoringv1.ServiceMonitor) bool {
+	for _, f := range sm.Finalizers {
+		if f == Finalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ensureFinalizer adds the finalizer to the ServiceMonitor if it is not already present, returning the
+// updated ServiceMonitor.
+func (c *Controller) ensureFinalizer(ctx context.Context, sm *monitoringv1.ServiceMonitor) (*monitoringv1.ServiceMonitor, error) {
+	if hasFinalizer(sm) {
+		return sm, nil
+	}
+
+	c.log.WithFields(fieldsForServiceMonitor(sm)).Debug("Adding finalizer")
+	updated := sm.DeepCopy()
+	updated.Finalizers = append(updated.Finalizers, Finalizer)
+
+	result, err := c.monitoring.MonitoringV1().ServiceMonitors(sm.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add finalizer: %w", err)
+	}
+
+	return result, nil
+}
+
+// finalize deletes the agent configs for a ServiceMonitor that is being deleted and then removes the
+// finalizer so the deletion can complete.
+func (c *Controller) finalize(ctx context.Context, sm *monitoringv1.ServiceMonitor) error {
+	if !hasFinalizer(sm) {
+		return nil
+	}
+
+	log := c.log.WithFields(fieldsForServiceMonitor(sm))
+	log.Debug("Deleting scrape configs for finalizing ServiceMonitor")
+
+	for _, name := range config.InstanceNames(sm) {
+		if err := c.deleteConfig(name); err != nil {
+			return fmt.Errorf("failed to delete config: %w", err)
+		}
+	}
+
+	_, err := c.removeFinalizer(ctx, sm)
+	return err
+}
+
+// removeFinalizer removes the finalizer from the ServiceMonitor, returning the updated ServiceMonitor. Without
+// --finalizers, it is removed from ServiceMonitors that still have it from an earlier run with --finalizers, so
+// deleting them does not wait for the operator.
+func (c *Controller) removeFinalizer(ctx context.Context, sm *monitoringv1.ServiceMonitor) (*monitoringv1.ServiceMonitor, error) {
+	if !hasFinalizer(sm) {
+		return sm, nil
+	}
+
+	updated := sm.DeepCopy()
+	updated.Finalizers = nil
+	for _, f := range sm.Finalizers {
+		if f != Finalizer {
+			updated.Finalizers = append(updated.Finalizers, f)
+		}
+	}
+
+	c.log.WithFields(fieldsForServiceMonitor(sm)).Debug("Removing finalizer")
+	result, err := c.monitoring.MonitoringV1().ServiceMonitors(sm.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove finalizer: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package operator
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	monitoringclientv1 "github.com/prometheus-operator/prometheus-operator/pkg/client/listers/monitoring/v1"
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned/fake"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+type recordingConfigManager struct {
+	noopConfigManager
+
+	deleted []string
+}
+
+func (r *recordingConfigManager) DeleteScrapeConfig(cfg *instance.Config) error {
+	r.deleted = append(r.deleted, cfg.Name)
+	return nil
+}
+
+func TestFinalizer(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Port: "a"}, {Port: "b"}},
+		},
+	}
+
+	get := func(t *testing.T, c *Controller) *monitoringv1.ServiceMonitor {
+		result, err := c.monitoring.MonitoringV1().ServiceMonitors("myapp").Get(context.Background(), "dummy", metav1.GetOptions{})
+		require.NoError(t, err)
+		return result
+	}
+
+	t.Run("Adds Finalizer", func(t *testing.T) {
+		sut := &Controller{monitoring: fake.NewSimpleClientset(sm.DeepCopy()), log: logrus.StandardLogger()}
+
+		result, err := sut.ensureFinalizer(context.Background(), sm)
+		require.NoError(t, err)
+		assert.Equal(t, []string{Finalizer}, result.Finalizers)
+		assert.Equal(t, []string{Finalizer}, get(t, sut).Finalizers)
+		assert.Empty(t, sm.Finalizers, "cached object should not be modified")
+	})
+
+	t.Run("Finalize", func(t *testing.T) {
+		existing := sm.DeepCopy()
+		now := metav1.Now()
+		existing.DeletionTimestamp = &now
+		existing.Finalizers = []string{"other", Finalizer}
+
+		manager := &recordingConfigManager{}
+		sut := &Controller{
+			monitoring:   fake.NewSimpleClientset(existing.DeepCopy()),
+			configWriter: testWriter(),
+			manager:      manager,
+			log:          logrus.StandardLogger(),
+		}
+
+		require.NoError(t, sut.finalize(context.Background(), existing))
+		assert.Equal(t, []string{"myapp/dummy/0", "myapp/dummy/1"}, manager.deleted)
+		assert.Equal(t, []string{"other"}, get(t, sut).Finalizers)
+	})
+
+	t.Run("Finalize Invalid ServiceMonitor", func(t *testing.T) {
+		existing := sm.DeepCopy()
+		now := metav1.Now()
+		existing.DeletionTimestamp = &now
+		existing.Finalizers = []string{Finalizer}
+		existing.Spec.Endpoints[1].RelabelConfigs = []*monitoringv1.RelabelConfig{{Action: "explode"}}
+
+		manager := &recordingConfigManager{}
+		sut := &Controller{
+			monitoring:   fake.NewSimpleClientset(existing.DeepCopy()),
+			configWriter: testWriter(),
+			manager:      manager,
+			log:          logrus.StandardLogger(),
+		}
+
+		require.NoError(t, sut.finalize(context.Background(), existing))
+		assert.Equal(t, []string{"myapp/dummy/0", "myapp/dummy/1"}, manager.deleted)
+	})
+
+	t.Run("Removes Leftover Finalizer", func(t *testing.T) {
+		existing := sm.DeepCopy()
+		existing.Finalizers = []string{"other", Finalizer}
+
+		manager := &recordingConfigManager{}
+		sut := makeTestController(t, manager, existing.DeepCopy())
+		sut.serviceMonitorLister = monitoringclientv1.NewServiceMonitorLister(sut.serviceMoniotrInformer.GetIndexer())
+		sut.monitoring = fake.NewSimpleClientset(existing.DeepCopy())
+		sut.recorder = record.NewFakeRecorder(10)
+		sut.removeFinalizers = true
+
+		require.NoError(t, sut.syncCachedKey(context.Background(), "myapp/dummy"))
+		assert.Equal(t, []string{"other"}, get(t, sut).Finalizers)
+		assert.Empty(t, manager.deleted)
+	})
+
+	t.Run("Finalizes With Leftover Finalizer", func(t *testing.T) {
+		existing := sm.DeepCopy()
+		now := metav1.Now()
+		existing.DeletionTimestamp = &now
+		existing.Finalizers = []string{Finalizer}
+
+		manager := &recordingConfigManager{}
+		sut := makeTestController(t, manager, existing.DeepCopy())
+		sut.serviceMonitorLister = monitoringclientv1.NewServiceMonitorLister(sut.serviceMoniotrInformer.GetIndexer())
+		sut.monitoring = fake.NewSimpleClientset(existing.DeepCopy())
+		sut.recorder = record.NewFakeRecorder(10)
+		sut.removeFinalizers = true
+
+		require.NoError(t, sut.syncCachedKey(context.Background(), "myapp/dummy"))
+		assert.Equal(t, []string{"myapp/dummy/0", "myapp/dummy/1"}, manager.deleted)
+		assert.Empty(t, get(t, sut).Finalizers)
+	})
+
+	t.Run("Finalize Without Finalizer", func(t *testing.T) {
+		manager := &recordingConfigManager{}
+		sut := &Controller{monitoring: fake.NewSimpleClientset(sm.DeepCopy()), manager: manager, log: logrus.StandardLogger()}
+
+		require.NoError(t, sut.finalize(context.Background(), sm))
+		assert.Empty(t, manager.deleted)
+	})
+}
@@ -1,8 +1,11 @@
 package operator
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
+	"github.com/nlowe/grafana-agent-operator/config"
 	"github.com/nlowe/grafana-agent-operator/k8sutil"
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -14,11 +17,13 @@ import (
 const (
 	SuccessfullySynced = "Synced"
 	FailedSync         = "FailedSync"
+	FailedValidation   = "FailedValidation"
+	LimitEnforced      = "LimitEnforced"
 
 	MessageSuccessfullySynced = "Scrape Configuration '%s' synced with agent"
 )
 
-func (c *Controller) reconcile() bool {
+func (c *Controller) reconcile(ctx context.Context) bool {
 	item, shutdown := c.work.Get()
 
 	if shutdown {
@@ -41,10 +46,21 @@ func (c *Controller) reconcile() bool {
 		log := c.log.WithField("serviceMonitor", target.key)
 
 		var err error
-		if target.delete {
+		switch {
+		case target.kind == kindListStaleConfigs:
+			err = c.enqueueStaleConfigs()
+		case target.kind == kindStaleConfig:
+			err = c.deleteStaleConfig(target.key)
+		case target.delete:
 			err = c.deleteCachedKey(target.key)
-		} else {
-			err = c.syncCachedKey(target.key)
+		default:
+			err = c.syncCachedKey(ctx, target.key)
+		}
+
+		if err != nil && isPermanent(err) {
+			// Don't retry until the ServiceMonitor changes
+			c.work.Forget(obj)
+			return fmt.Errorf("giving up on %s %s: %w", target.kind, target.key, err)
 		}
 
 		if err != nil {
@@ -60,7 +76,7 @@ func (c *Controller) reconcile() bool {
 	return true
 }
 
-func (c *Controller) syncCachedKey(key string) error {
+func (c *Controller) syncCachedKey(ctx context.Context, key string) error {
 	ns, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("invalid resource key '%s': %w", key, err))
@@ -77,15 +93,54 @@ func (c *Controller) syncCachedKey(key string) error {
 		return err
 	}
 
+	if c.useFinalizers {
+		if sm.DeletionTimestamp != nil {
+			return c.finalize(ctx, sm)
+		}
+
+		if sm, err = c.ensureFinalizer(ctx, sm); err != nil {
+			return err
+		}
+	} else if c.removeFinalizers && hasFinalizer(sm) {
+		// Left behind by an earlier run with finalizers, clean up as if they were still enabled
+		if sm.DeletionTimestamp != nil {
+			return c.finalize(ctx, sm)
+		}
+
+		if sm, err = c.removeFinalizer(ctx, sm); err != nil {
+			return err
+		}
+	}
+
 	if err := k8sutil.AddTypeMetaToObject(sm); err != nil {
 		return err
 	}
 
+	writer := c.writer()
+	if err := writer.Validate(sm); err != nil {
+		err = withKind(ErrInvalidConfig, fmt.Errorf("invalid ServiceMonitor: %w", err))
+		c.recorder.Event(sm, corev1.EventTypeWarning, FailedValidation, err.Error())
+		c.updateSyncStatus(ctx, sm, nil, err)
+		return err
+	}
+
 	c.log.WithField("serviceMonitor", key).Debug("Creating or updating scrape configs")
-	for _, cfg := range c.configWriter.ScrapeConfigsForServiceMonitor(sm) {
+	cfgs, warnings, err := writer.ScrapeConfigsForServiceMonitor(sm)
+	if err != nil {
+		// Validation should have caught this already
+		err = withKind(ErrInvalidConfig, fmt.Errorf("invalid ServiceMonitor: %w", err))
+		c.recorder.Event(sm, corev1.EventTypeWarning, FailedValidation, err.Error())
+		c.updateSyncStatus(ctx, sm, nil, err)
+		return err
+	}
+
+	c.recordLimitWarnings(key, sm, warnings)
+
+	for _, cfg := range cfgs {
 		if err := c.manager.UpdateScrapeConfig(cfg); err != nil {
 			utilruntime.HandleError(fmt.Errorf("failed to sync config: %w", err))
 			c.recorder.Event(sm, corev1.EventTypeWarning, FailedSync, err.Error())
+			c.updateSyncStatus(ctx, sm, cfgs, err)
 			return err
 		}
 
@@ -97,6 +152,7 @@ func (c *Controller) syncCachedKey(key string) error {
 		)
 	}
 
+	c.updateSyncStatus(ctx, sm, cfgs, nil)
 	return nil
 }
 
@@ -129,9 +185,11 @@ func (c *Controller) deleteCachedKey(key string) error {
 		sm = obj.(*monitoringv1.ServiceMonitor)
 	}
 
+	c.forgetLimitWarnings(key)
+
 	c.log.WithField("serviceMonitor", key).Debug("Calculating scrape configs to delete")
-	for _, cfg := range c.configWriter.ScrapeConfigsForServiceMonitor(sm) {
-		if err := c.manager.DeleteScrapeConfig(cfg); err != nil {
+	for _, name := range config.InstanceNames(sm) {
+		if err := c.deleteConfig(name); err != nil {
 			utilruntime.HandleError(fmt.Errorf("failed to sync config: %w", err))
 			return err
 		}
@@ -139,3 +197,57 @@ func (c *Controller) deleteCachedKey(key string) error {
 
 	return nil
 }
+
+// recordLimitWarnings records a LimitEnforced event for each warning, unless the same warnings were already recorded
+// for this generation of the ServiceMonitor
+func (c *Controller) recordLimitWarnings(key string, sm *monitoringv1.ServiceMonitor, warnings []string) {
+	fingerprint := fmt.Sprintf("%d\n%s", sm.Generation, strings.Join(warnings, "\n"))
+
+	c.limitWarningsLock.Lock()
+	if c.limitWarnings == nil {
+		c.limitWarnings = map[string]string{}
+	}
+
+	recorded := c.limitWarnings[key] == fingerprint
+	if len(warnings) == 0 {
+		delete(c.limitWarnings, key)
+	} else {
+		c.limitWarnings[key] = fingerprint
+	}
+	c.limitWarningsLock.Unlock()
+
+	if recorded {
+		return
+	}
+
+	for _, warning := range warnings {
+		c.recorder.Event(sm, corev1.EventTypeWarning, LimitEnforced, warning)
+	}
+}
+
+func (c *Controller) forgetLimitWarnings(key string) {
+	c.limitWarningsLock.Lock()
+	defer c.limitWarningsLock.Unlock()
+
+	delete(c.limitWarnings, key)
+}
+
+// deleteStaleConfig deletes a config that did not belong to any ServiceMonitor when it was queued. A ServiceMonitor
+// may have been created since then, so ownership is checked again before deleting.
+func (c *Controller) deleteStaleConfig(name string) error {
+	log := c.log.WithField("config", name)
+	if owned, err := c.ownsConfig(name); err != nil {
+		return fmt.Errorf("failed to check the owner of stale config: %w", err)
+	} else if owned {
+		log.Debug("Config belongs to a ServiceMonitor again, not deleting it")
+		return nil
+	}
+
+	log.Debug("Deleting stale config")
+	if err := c.deleteConfig(name); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to delete stale config: %w", err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	StatusSynced = "Synced"
+	StatusFailed = "Failed"
+
+	AnnotationSyncStatus       = "grafana-agent-operator/sync-status"
+	AnnotationSyncedGeneration = "grafana-agent-operator/synced-generation"
+	AnnotationConfigs          = "grafana-agent-operator/configs"
+	AnnotationLastError        = "grafana-agent-operator/last-error"
+	AnnotationAgentURL         = "grafana-agent-operator/agent-url"
+)
+
+// statusAnnotations are the annotations the operator writes to ServiceMonitors after syncing them
+var statusAnnotations = map[string]struct{}{
+	AnnotationSyncStatus:       {},
+	AnnotationSyncedGeneration: {},
+	AnnotationConfigs:          {},
+	AnnotationLastError:        {},
+	AnnotationAgentURL:         {},
+}
+
+// onlyStatusChanged returns true if the only difference between two versions of a ServiceMonitor are the
+// statusAnnotations, so the update was caused by the operator recording a sync and does not need to be synced
+// again
+func onlyStatusChanged(oldSm, newSm *monitoringv1.ServiceMonitor) bool {
+	if oldSm.Generation != newSm.Generation ||
+		!reflect.DeepEqual(oldSm.Labels, newSm.Labels) ||
+		!reflect.DeepEqual(oldSm.Finalizers, newSm.Finalizers) ||
+		!reflect.DeepEqual(oldSm.DeletionTimestamp, newSm.DeletionTimestamp) {
+		return false
+	}
+
+	withoutStatus := func(annotations map[string]string) map[string]string {
+		result := map[string]string{}
+		for k, v := range annotations {
+			if _, status := statusAnnotations[k]; !status {
+				result[k] = v
+			}
+		}
+
+		return result
+	}
+
+	return reflect.DeepEqual(withoutStatus(oldSm.Annotations), withoutStatus(newSm.Annotations))
+}
+
+// syncStatusAnnotations calculates the annotations describing the outcome of a sync. A nil value means the
+// annotation should be removed. The synced generation is only advanced on success so it always reflects the
+// last generation that is live on the agent.
+func syncStatusAnnotations(sm *monitoringv1.ServiceMonitor, cfgs []*instance.Config, agentURL string, syncErr error) map[string]*string {
+	names := make([]string, len(cfgs))
+	for i, cfg := range cfgs {
+		names[i] = cfg.Name
+	}
+
+	str := func(s string) *string {
+		return &s
+	}
+
+	result := map[string]*string{
+		AnnotationConfigs:  str(strings.Join(names, ",")),
+		AnnotationAgentURL: str(agentURL),
+	}
+
+	if syncErr != nil {
+		result[AnnotationSyncStatus] = str(StatusFailed)
+		result[AnnotationLastError] = str(syncErr.Error())
+	} else {
+		result[AnnotationSyncStatus] = str(StatusSynced)
+		result[AnnotationSyncedGeneration] = str(strconv.FormatInt(sm.Generation, 10))
+		result[AnnotationLastError] = nil
+	}
+
+	return result
+}
+
+func (c *Controller) updateSyncStatus(ctx context.Context, sm *monitoringv1.ServiceMonitor, cfgs []*instance.Config, syncErr error) {
+	if !c.recordStatus {
+		return
+	}
+
+	log := c.log.WithFields(fieldsForServiceMonitor(sm))
+	annotations := syncStatusAnnotations(sm, cfgs, c.agentURL, syncErr)
+
+	// Only patch if something changed, otherwise every sync would trigger another update
+	changed := false
+	for k, v := range annotations {
+		current, set := sm.Annotations[k]
+		if (v == nil && set) || (v != nil && (!set || current != *v)) {
+			changed = true
+			break
+		}
+	}
+
+	if !changed {
+		log.Trace("Sync status unchanged")
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal sync status")
+		return
+	}
+
+	log.Debug("Recording sync status")
+	if _, err := c.monitoring.MonitoringV1().ServiceMonitors(sm.Namespace).Patch(
+		ctx, sm.Name, types.MergePatchType, patch, metav1.PatchOptions{},
+	); err != nil {
+		log.WithError(err).Error("Failed to record sync status")
+	}
+}
@@ -0,0 +1,129 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus-operator/prometheus-operator/pkg/client/versioned/fake"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateSyncStatus(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sm := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp", Generation: 3},
+	}
+	cfgs := []*instance.Config{{Name: "myapp/dummy/0"}, {Name: "myapp/dummy/1"}}
+
+	get := func(t *testing.T, c *Controller) *monitoringv1.ServiceMonitor {
+		result, err := c.monitoring.MonitoringV1().ServiceMonitors("myapp").Get(context.Background(), "dummy", metav1.GetOptions{})
+		require.NoError(t, err)
+		return result
+	}
+
+	t.Run("Synced", func(t *testing.T) {
+		sut := &Controller{monitoring: fake.NewSimpleClientset(sm.DeepCopy()), agentURL: "http://agent", recordStatus: true, log: logrus.StandardLogger()}
+		sut.updateSyncStatus(context.Background(), sm, cfgs, nil)
+
+		result := get(t, sut)
+		assert.Equal(t, map[string]string{
+			AnnotationSyncStatus:       StatusSynced,
+			AnnotationSyncedGeneration: "3",
+			AnnotationConfigs:          "myapp/dummy/0,myapp/dummy/1",
+			AnnotationAgentURL:         "http://agent",
+		}, result.Annotations)
+
+		t.Run("Failed", func(t *testing.T) {
+			sut.updateSyncStatus(context.Background(), result, cfgs, fmt.Errorf("dummy"))
+
+			result := get(t, sut)
+			assert.Equal(t, StatusFailed, result.Annotations[AnnotationSyncStatus])
+			assert.Equal(t, "3", result.Annotations[AnnotationSyncedGeneration])
+			assert.Equal(t, "dummy", result.Annotations[AnnotationLastError])
+		})
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		existing := sm.DeepCopy()
+		existing.Annotations = map[string]string{
+			AnnotationSyncStatus:       StatusSynced,
+			AnnotationSyncedGeneration: "3",
+			AnnotationConfigs:          "myapp/dummy/0,myapp/dummy/1",
+			AnnotationAgentURL:         "http://agent",
+		}
+
+		client := fake.NewSimpleClientset(existing)
+		sut := &Controller{monitoring: client, agentURL: "http://agent", recordStatus: true, log: logrus.StandardLogger()}
+		sut.updateSyncStatus(context.Background(), existing, cfgs, nil)
+
+		assert.Empty(t, client.Actions())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		client := fake.NewSimpleClientset(sm.DeepCopy())
+		sut := &Controller{monitoring: client, log: logrus.StandardLogger()}
+		sut.updateSyncStatus(context.Background(), sm, cfgs, nil)
+
+		assert.Empty(t, client.Actions())
+	})
+}
+
+func TestOnlyStatusChanged(t *testing.T) {
+	old := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "dummy",
+			Namespace:       "myapp",
+			Generation:      3,
+			ResourceVersion: "10",
+			Labels:          map[string]string{"app": "myapp"},
+			Annotations:     map[string]string{"example.com/owner": "team"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(sm *monitoringv1.ServiceMonitor)
+		expected bool
+	}{
+		{name: "Status Recorded", expected: true, mutate: func(sm *monitoringv1.ServiceMonitor) {
+			sm.Annotations[AnnotationSyncStatus] = StatusSynced
+			sm.Annotations[AnnotationSyncedGeneration] = "3"
+			sm.Annotations[AnnotationConfigs] = "myapp/dummy/0"
+		}},
+		{name: "Generation", mutate: func(sm *monitoringv1.ServiceMonitor) {
+			sm.Generation++
+			sm.Annotations[AnnotationSyncStatus] = StatusSynced
+		}},
+		{name: "Other Annotation", mutate: func(sm *monitoringv1.ServiceMonitor) {
+			sm.Annotations["example.com/owner"] = "other-team"
+		}},
+		{name: "Labels", mutate: func(sm *monitoringv1.ServiceMonitor) {
+			sm.Labels["app"] = "other"
+		}},
+		{name: "Finalizers", mutate: func(sm *monitoringv1.ServiceMonitor) {
+			sm.Finalizers = []string{Finalizer}
+		}},
+		{name: "Deleted", mutate: func(sm *monitoringv1.ServiceMonitor) {
+			now := metav1.Now()
+			sm.DeletionTimestamp = &now
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := old.DeepCopy()
+			updated.ResourceVersion = "11"
+			tt.mutate(updated)
+
+			assert.Equal(t, tt.expected, onlyStatusChanged(old, updated))
+		})
+	}
+}
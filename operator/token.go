@@ -0,0 +1,110 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlowe/grafana-agent-operator/config"
+	"github.com/spf13/viper"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// tokenRetryInterval is how long to wait before trying again when a token could not be minted
+const tokenRetryInterval = time.Minute
+
+// newWriter creates a config.Writer from the operator settings, authenticating to the API server with the token
+// minted for agent-side discovery if there is one and copying labels from the namespaces in the cache
+func (c *Controller) newWriter() (config.Writer, error) {
+	c.writerLock.RLock()
+	token := c.apiServerToken
+	c.writerLock.RUnlock()
+
+	var opts []config.Option
+	if token != "" {
+		opts = append(opts, config.WithAPIServerBearerToken(token))
+	}
+
+	if c.namespaceLister != nil {
+		opts = append(opts, config.WithNamespaceLister(c.namespaceLister))
+	}
+
+	return NewConfigWriter(opts...)
+}
+
+// mintAPIServerToken requests a token for the ServiceAccount the agents should use to discover targets and
+// rebuilds the config writer to use it, returning when the token expires
+func (c *Controller) mintAPIServerToken(ctx context.Context, sa types.NamespacedName, ttl time.Duration) (time.Time, error) {
+	seconds := int64(ttl.Seconds())
+	result, err := c.k.CoreV1().ServiceAccounts(sa.Namespace).CreateToken(ctx, sa.Name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &seconds},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to create token for ServiceAccount %s: %w", sa, err)
+	}
+
+	c.writerLock.Lock()
+	c.apiServerToken = result.Status.Token
+	c.writerLock.Unlock()
+
+	writer, err := c.newWriter()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c.writerLock.Lock()
+	c.configWriter = writer
+	c.writerLock.Unlock()
+
+	c.log.WithField("serviceAccount", sa).WithField("expires", result.Status.ExpirationTimestamp.Time).Info("Minted API server token for agent-side discovery")
+	return result.Status.ExpirationTimestamp.Time, nil
+}
+
+// runTokenRefresher mints a new token once most of the lifetime of the current one has passed and re-syncs every
+// ServiceMonitor so the agents pick it up before the old one expires
+func (c *Controller) runTokenRefresher(ctx context.Context, sa types.NamespacedName, ttl time.Duration, expiry time.Time) {
+	wait := refreshAfter(expiry)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		next, err := c.mintAPIServerToken(ctx, sa, ttl)
+		if err != nil {
+			c.log.WithError(err).Error("Failed to refresh API server token")
+			wait = tokenRetryInterval
+			continue
+		}
+
+		wait = refreshAfter(next)
+		if err := c.Reload(); err != nil {
+			c.log.WithError(err).Error("Failed to reload after refreshing the API server token")
+		}
+	}
+}
+
+// refreshAfter returns how long to wait before refreshing a token that expires at expiry, leaving a fifth of its
+// remaining lifetime for the agents to pick up the new one
+func refreshAfter(expiry time.Time) time.Duration {
+	wait := time.Until(expiry) * 4 / 5
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// apiServerTokenSettings returns the ServiceAccount to mint tokens for and their lifetime, if enabled
+func apiServerTokenSettings() (types.NamespacedName, time.Duration, bool) {
+	ns, name, err := cache.SplitMetaNamespaceKey(viper.GetString("sd-token-service-account"))
+	if err != nil || name == "" {
+		return types.NamespacedName{}, 0, false
+	}
+
+	return types.NamespacedName{Namespace: ns, Name: name}, viper.GetDuration("sd-token-ttl"), true
+}
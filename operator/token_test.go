@@ -0,0 +1,77 @@
+package operator
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/discovery/kubernetes"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMintAPIServerToken(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("remote-write-url", "http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	viper.Set("sd-api-server", "https://cluster-a.example.com:6443")
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	var requested *authenticationv1.TokenRequest
+
+	k8s := k8sfake.NewSimpleClientset()
+	k8s.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateAction)
+		if create.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+
+		requested = create.GetObject().(*authenticationv1.TokenRequest)
+		return true, &authenticationv1.TokenRequest{Status: authenticationv1.TokenRequestStatus{
+			Token:               "minted",
+			ExpirationTimestamp: metav1.NewTime(expiry),
+		}}, nil
+	})
+
+	sut := &Controller{k: k8s, log: logrus.StandardLogger()}
+
+	result, err := sut.mintAPIServerToken(context.Background(), types.NamespacedName{Namespace: "monitoring", Name: "agent"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, expiry, result)
+	assert.Equal(t, int64(3600), *requested.Spec.ExpirationSeconds)
+
+	cfgs, _, err := sut.writer().ScrapeConfigsForServiceMonitor(&monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, cfgs, 1)
+
+	sd := cfgs[0].ScrapeConfigs[0].ServiceDiscoveryConfigs[0].(*kubernetes.SDConfig)
+	assert.Equal(t, "https://cluster-a.example.com:6443", sd.APIServer.String())
+	assert.Equal(t, "minted", string(sd.HTTPClientConfig.BearerToken))
+
+	raw, err := instance.MarshalConfig(cfgs[0], false)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "bearer_token: minted")
+}
+
+func TestRefreshAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), refreshAfter(time.Now().Add(-time.Minute)))
+
+	wait := refreshAfter(time.Now().Add(100 * time.Minute))
+	assert.True(t, wait > 79*time.Minute && wait <= 80*time.Minute, "unexpected wait %s", wait)
+}
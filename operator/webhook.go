@@ -0,0 +1,186 @@
+package operator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/nlowe/grafana-agent-operator/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	reviewAllowed = "allowed"
+	reviewWarned  = "warned"
+	reviewDenied  = "denied"
+
+	// maxReviewSize limits the size of admission reviews, which are well below this even for large ServiceMonitors
+	maxReviewSize = 3 * 1024 * 1024
+)
+
+var webhookReviewsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grafana_agent_operator_webhook_reviews_total",
+	Help: "Total number of ServiceMonitors reviewed by the validating admission webhook, by result",
+}, []string{"result"})
+
+type webhookHandler struct {
+	writer   func() config.Writer
+	warnOnly bool
+
+	log logrus.FieldLogger
+}
+
+// WebhookHandler serves a validating admission webhook for ServiceMonitors. It rejects ServiceMonitors that the
+// controller would fail to sync, validating them with the same settings as the controller, and warns about values
+// that would be overridden to stay within the limits. With warnOnly, invalid ServiceMonitors are admitted with
+// warnings instead of being rejected.
+func (c *Controller) WebhookHandler(warnOnly bool) http.Handler {
+	return newWebhookHandler(c.writer, warnOnly)
+}
+
+func newWebhookHandler(writer func() config.Writer, warnOnly bool) *webhookHandler {
+	return &webhookHandler{
+		writer:   writer,
+		warnOnly: warnOnly,
+		log:      logrus.WithField("prefix", "webhook"),
+	}
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReviewSize)).Decode(review); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode admission review: %v", err), http.StatusBadRequest)
+		return
+	} else if review.Request == nil {
+		http.Error(w, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+
+	response := h.review(review.Request)
+	response.UID = review.Request.UID
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Response: response,
+	}); err != nil {
+		h.log.WithError(err).Error("Failed to write admission review response")
+	}
+}
+
+func (h *webhookHandler) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Kind.Kind != monitoringv1.ServiceMonitorsKind {
+		h.log.WithField("kind", req.Kind.String()).Warn("Admitting unexpected kind, check the webhook configuration")
+		return allowed
+	} else if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return allowed
+	}
+
+	sm := &monitoringv1.ServiceMonitor{}
+	if err := json.Unmarshal(req.Object.Raw, sm); err != nil {
+		webhookReviewsTotal.WithLabelValues(reviewDenied).Inc()
+		return &admissionv1.AdmissionResponse{Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: fmt.Sprintf("failed to decode ServiceMonitor: %v", err),
+		}}
+	}
+
+	// Configs are named after the ServiceMonitor, which may not have a name or namespace yet
+	if sm.Namespace == "" {
+		sm.Namespace = req.Namespace
+	}
+	if sm.Name == "" {
+		sm.Name = req.Name
+	}
+	if sm.Name == "" {
+		sm.Name = sm.GenerateName
+	}
+
+	// ServiceMonitors that are being deleted and changes that do not affect the generated configs, like the
+	// operator recording the sync status or removing its finalizer, must not be blocked by an invalid spec
+	if req.Operation == admissionv1.Update {
+		old := &monitoringv1.ServiceMonitor{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err == nil && (sm.DeletionTimestamp != nil || !configInputsChanged(old, sm)) {
+			webhookReviewsTotal.WithLabelValues(reviewAllowed).Inc()
+			return allowed
+		}
+	}
+
+	log := h.log.WithFields(fieldsForServiceMonitor(sm)).WithField("operation", req.Operation)
+
+	writer := h.writer()
+	if err := writer.Validate(sm); err != nil {
+		if h.warnOnly {
+			log.WithError(err).Info("Admitting invalid ServiceMonitor in warn-only mode")
+			webhookReviewsTotal.WithLabelValues(reviewWarned).Inc()
+
+			for _, msg := range errorMessages(err) {
+				allowed.Warnings = append(allowed.Warnings, "invalid, the operator will not sync this ServiceMonitor: "+msg)
+			}
+			return allowed
+		}
+
+		log.WithError(err).Info("Rejecting invalid ServiceMonitor")
+		webhookReviewsTotal.WithLabelValues(reviewDenied).Inc()
+		return &admissionv1.AdmissionResponse{Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusUnprocessableEntity,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: fmt.Sprintf("invalid ServiceMonitor: %v", err),
+		}}
+	}
+
+	// Validation already generated the configs, so this cannot fail
+	_, warnings, _ := writer.ScrapeConfigsForServiceMonitor(sm)
+	allowed.Warnings = warnings
+
+	webhookReviewsTotal.WithLabelValues(reviewAllowed).Inc()
+	return allowed
+}
+
+// configInputsChanged returns true if the configs generated for after may differ from the ones generated for before
+func configInputsChanged(before, after *monitoringv1.ServiceMonitor) bool {
+	if !reflect.DeepEqual(before.Spec, after.Spec) {
+		return true
+	}
+
+	for _, key := range config.InstanceSettingsAnnotations {
+		if before.Annotations[key] != after.Annotations[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorMessages splits aggregated validation errors so each one becomes a separate warning
+func errorMessages(err error) []string {
+	var agg utilerrors.Aggregate
+	if !errors.As(err, &agg) {
+		return []string{err.Error()}
+	}
+
+	var result []string
+	for _, e := range agg.Errors() {
+		result = append(result, e.Error())
+	}
+
+	return result
+}
@@ -0,0 +1,143 @@
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	commonconfig "github.com/prometheus/common/config"
+	promcfg "github.com/prometheus/prometheus/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestWebhook(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	u, _ := url.Parse("http://cortex.monitoring.svc.cluster.local/api/prom/push")
+	writer := config.NewWriter(
+		&instance.RemoteWriteConfig{Base: promcfg.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}}},
+		config.WithLimits(config.Limits{MaxSampleLimit: 1000}),
+	)
+
+	valid := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Name: "dummy", Namespace: "myapp"},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Port: "metrics"}},
+		},
+	}
+
+	invalid := valid.DeepCopy()
+	invalid.Spec.Endpoints[0].RelabelConfigs = []*monitoringv1.RelabelConfig{{Action: "explode"}}
+
+	overLimit := valid.DeepCopy()
+	overLimit.Spec.SampleLimit = 5000
+
+	raw := func(sm *monitoringv1.ServiceMonitor) runtime.RawExtension {
+		if sm == nil {
+			return runtime.RawExtension{}
+		}
+
+		result, err := json.Marshal(sm)
+		require.NoError(t, err)
+		return runtime.RawExtension{Raw: result}
+	}
+
+	request := func(op admissionv1.Operation, sm, old *monitoringv1.ServiceMonitor) *admissionv1.AdmissionRequest {
+		return &admissionv1.AdmissionRequest{
+			UID:       types.UID("1234"),
+			Kind:      metav1.GroupVersionKind{Group: monitoringv1.SchemeGroupVersion.Group, Version: "v1", Kind: monitoringv1.ServiceMonitorsKind},
+			Namespace: "myapp",
+			Operation: op,
+			Object:    raw(sm),
+			OldObject: raw(old),
+		}
+	}
+
+	t.Run("HTTP", func(t *testing.T) {
+		body, err := json.Marshal(&admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request:  request(admissionv1.Create, invalid, nil),
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		newWebhookHandler(func() config.Writer { return writer }, false).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate-servicemonitor", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		review := &admissionv1.AdmissionReview{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), review))
+		assert.Equal(t, "admission.k8s.io/v1", review.APIVersion)
+		assert.Equal(t, "AdmissionReview", review.Kind)
+		require.NotNil(t, review.Response)
+		assert.Equal(t, types.UID("1234"), review.Response.UID)
+		assert.False(t, review.Response.Allowed)
+		assert.Equal(t, int32(http.StatusUnprocessableEntity), review.Response.Result.Code)
+		assert.Contains(t, review.Response.Result.Message, `spec.endpoints[0].relabelings[0].action: Unsupported value: "explode"`)
+	})
+
+	t.Run("Malformed Review", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		newWebhookHandler(func() config.Writer { return writer }, false).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate-servicemonitor", bytes.NewReader([]byte("{"))))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	generated := valid.DeepCopy()
+	generated.Name = ""
+	generated.Namespace = ""
+	generated.GenerateName = "dummy-"
+
+	deleting := invalid.DeepCopy()
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+
+	statusOnly := invalid.DeepCopy()
+	statusOnly.Annotations = map[string]string{AnnotationSyncStatus: "Failed"}
+
+	settingsChanged := invalid.DeepCopy()
+	settingsChanged.Annotations = map[string]string{config.AnnotationMinWALTime: "1m"}
+
+	tests := []struct {
+		name     string
+		warnOnly bool
+		req      *admissionv1.AdmissionRequest
+		allowed  bool
+		warnings int
+	}{
+		{name: "Valid", req: request(admissionv1.Create, valid, nil), allowed: true},
+		{name: "Generated Name", req: request(admissionv1.Create, generated, nil), allowed: true},
+		{name: "Invalid", req: request(admissionv1.Create, invalid, nil)},
+		{name: "Invalid Warn Only", warnOnly: true, req: request(admissionv1.Create, invalid, nil), allowed: true, warnings: 1},
+		{name: "Over Limit", req: request(admissionv1.Create, overLimit, nil), allowed: true, warnings: 1},
+		{name: "Update To Invalid", req: request(admissionv1.Update, invalid, valid)},
+		{name: "Update Status Of Invalid", req: request(admissionv1.Update, statusOnly, invalid), allowed: true},
+		{name: "Update Settings Of Invalid", req: request(admissionv1.Update, settingsChanged, invalid)},
+		{name: "Remove Finalizer From Invalid", req: request(admissionv1.Update, deleting, invalid), allowed: true},
+		{name: "Delete", req: request(admissionv1.Delete, nil, invalid), allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := newWebhookHandler(func() config.Writer { return writer }, tt.warnOnly)
+
+			response := sut.review(tt.req)
+			assert.Equal(t, tt.allowed, response.Allowed)
+			assert.Len(t, response.Warnings, tt.warnings)
+			if !tt.allowed {
+				require.NotNil(t, response.Result)
+				assert.Equal(t, metav1.StatusReasonInvalid, response.Result.Reason)
+			}
+		})
+	}
+}
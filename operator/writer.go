@@ -0,0 +1,89 @@
+package operator
+
+import (
+	"net/url"
+
+	"github.com/grafana/agent/pkg/prom/instance"
+	"github.com/nlowe/grafana-agent-operator/config"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	promcfg "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/kubernetes"
+	"github.com/spf13/viper"
+)
+
+// NewConfigWriter creates a config.Writer using the operator settings. opts are applied after the settings.
+func NewConfigWriter(opts ...config.Option) (config.Writer, error) {
+	u, err := url.Parse(viper.GetString("remote-write-url"))
+	if err != nil {
+		return nil, err
+	}
+
+	apiServer, err := apiServerSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	staticLabels, err := staticLabelSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	return config.NewWriter(&instance.RemoteWriteConfig{
+		Base: promcfg.RemoteWriteConfig{URL: &commonconfig.URL{URL: u}},
+	}, append([]config.Option{
+		config.WithLimits(config.Limits{
+			DefaultInterval: model.Duration(viper.GetDuration("default-scrape-interval")),
+			DefaultTimeout:  model.Duration(viper.GetDuration("default-scrape-timeout")),
+			MinInterval:     model.Duration(viper.GetDuration("min-scrape-interval")),
+			MaxSampleLimit:  viper.GetUint("max-sample-limit"),
+			MaxTargetLimit:  viper.GetUint("max-target-limit"),
+		}),
+		config.WithInstanceSettings(config.InstanceSettings{
+			WALTruncateFrequency: viper.GetDuration("wal-truncate-frequency"),
+			MinWALTime:           viper.GetDuration("min-wal-time"),
+			MaxWALTime:           viper.GetDuration("max-wal-time"),
+			RemoteFlushDeadline:  viper.GetDuration("remote-flush-deadline"),
+			WriteStaleOnShutdown: viper.GetBool("write-stale-on-shutdown"),
+		}),
+		config.WithHostFilter(viper.GetBool("host-filter")),
+		config.WithStaticLabels(staticLabels),
+		config.WithDiscoveryRole(kubernetes.Role(viper.GetString("discovery-role"))),
+		config.WithSelectorPushdown(viper.GetBool("sd-selector-pushdown")),
+		config.WithAPIServer(apiServer),
+	}, opts...)...), nil
+}
+
+func staticLabelSettings() (config.StaticLabels, error) {
+	result := config.StaticLabels{ConflictPolicy: config.LabelConflictPolicy(viper.GetString("label-conflict-policy"))}
+
+	var err error
+	if result.Labels, err = config.ParseLabelPairs(viper.GetStringSlice("static-labels")); err != nil {
+		return result, err
+	}
+
+	result.NamespaceLabels, err = config.ParseLabelPairs(viper.GetStringSlice("namespace-labels"))
+	return result, err
+}
+
+func apiServerSettings() (config.APIServer, error) {
+	result := config.APIServer{
+		CAFile:             viper.GetString("sd-api-server-ca-file"),
+		CertFile:           viper.GetString("sd-api-server-cert-file"),
+		KeyFile:            viper.GetString("sd-api-server-key-file"),
+		ServerName:         viper.GetString("sd-api-server-server-name"),
+		InsecureSkipVerify: viper.GetBool("sd-api-server-insecure-skip-verify"),
+		BearerTokenFile:    viper.GetString("sd-api-server-bearer-token-file"),
+	}
+
+	if raw := viper.GetString("sd-api-server"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return result, err
+		}
+
+		result.URL = u
+	}
+
+	return result, nil
+}